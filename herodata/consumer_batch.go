@@ -4,40 +4,53 @@ package herodata
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/url"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type BatchConsumer struct {
-	serverUrl     string // 其他的接收端地址
-	appId         string // 项目 APP ID
-	shuShuServerUrl string //数数接口地址
-	shuShuAppId     string //数数应用Id
+	destinations []*destination // 接收端列表, 每个接收端有独立的缓存和发送状态
 
 	timeout     time.Duration // 网络请求超时时间, 单位毫秒
 	compress    bool          // 是否数据压缩
-	bufferMutex *sync.Mutex
-	cacheMutex  *sync.Mutex // 缓存锁
+	retryPolicy RetryPolicy   // 重试策略
+	bufferMutex *sync.Mutex   // 保护 buffer 和 closed
 
 	buffer        []Data
 	batchSize     int
-	cacheBuffer   [][]Data // 缓存
-	cacheCapacity int      // 缓存最大容量
+	cacheCapacity int // 每个接收端的缓存最大容量
+
+	async           bool           // 异步模式, Add 只入队, 由后台 Go 程发送
+	queue           chan []Data    // 异步模式下待发送的批次, nil 表示只重发缓存区的数据
+	queueMutex      *sync.RWMutex  // 保护 queue 的关闭
+	overflowPolicy  OverflowPolicy // 异步队列已满时的处理方式
+	dropped         int64          // 因异步队列已满被丢弃的条数
+	closed          bool
+	done            chan struct{}      // 关闭时通知自动上传 Go 程退出
+	ctx             context.Context    // 自动上传和异步发送使用的 ctx, 关闭超时时取消
+	cancel          context.CancelFunc // 取消 ctx
+	wg              sync.WaitGroup
+	shutdownTimeout time.Duration // 关闭时等待剩余数据发送的最长时间
+
+	errorCallback     func(err error, data []Data)
+	deliveredCallback func(dest string, n int)
 }
 
 type BatchConfig struct {
-	ShuShuServerUrl string //数数接口地址
+	ShuShuServerUrl string //数数接口地址, 等同于 Destinations 中 Protocol 为 ProtocolShuShu、路径为 /sync_server 的接收端
 	ShuShuAppId     string //数数应用Id
-	ServerUrl     string // 其他的接收端地址
-	AppId         string // 项目 APP ID
+	ServerUrl       string // 其他的接收端地址
+	AppId           string // 项目 APP ID
+
+	Destinations []DestinationConfig // 额外的接收端, 与 ServerUrl、ShuShuServerUrl 一起推送
+
+	SpillDirectory string // 磁盘队列目录, 不为空时未发送的数据会持久化, 并在重启后重新发送
+	SpillMaxBytes  int64  // 每个接收端磁盘队列的最大字节数, 默认 DefaultSpillMaxBytes
 
 	BatchSize     int  // 批量上传数目
 	Timeout       int  // 网络请求超时时间, 单位毫秒
@@ -45,6 +58,18 @@ type BatchConfig struct {
 	AutoFlush     bool // 自动上传
 	Interval      int  // 自动上传间隔，单位秒
 	CacheCapacity int  // 缓存最大容量
+
+	Async          bool           // 异步模式, Add 只入队, 由后台 Go 程并发发送
+	Workers        int            // 异步模式下发送 Go 程数量, 默认 DefaultWorkers
+	QueueSize      int            // 异步模式下队列容量(批次数), 默认 DefaultQueueSize
+	OverflowPolicy OverflowPolicy // 异步队列已满时的处理方式, 默认阻塞
+
+	RetryPolicy *RetryPolicy // 重试策略, 为 nil 时使用 DefaultRetryPolicy()
+
+	ShutdownTimeout int // 关闭时等待剩余数据发送的最长时间, 单位毫秒, 0 表示不限制
+
+	OnError     func(err error, data []Data) // 发送失败或数据被丢弃时回调, 包括自动上传和异步发送中的错误
+	OnDelivered func(dest string, n int)     // 数据被接收端确认时回调, dest 为接收端名称, n 为条数
 }
 
 const (
@@ -53,16 +78,18 @@ const (
 	MaxBatchSize         = 200   // 最大批量发送条数
 	DefaultInterval      = 30    // 默认自动上传间隔 30 秒
 	DefaultCacheCapacity = 50
+	DefaultWorkers       = 4   // 默认异步发送 Go 程数量
+	DefaultQueueSize     = 100 // 默认异步队列容量
 )
 
 // 创建 BatchConsumer
-func NewBatchConsumer( shuShuServerUrl string, shuShuAppId string,serverUrl string, appId string,) (Consumer, error) {
+func NewBatchConsumer(shuShuServerUrl string, shuShuAppId string, serverUrl string, appId string) (Consumer, error) {
 	config := BatchConfig{
 		ShuShuServerUrl: shuShuServerUrl,
 		ShuShuAppId:     shuShuAppId,
-		ServerUrl:     serverUrl,
-		AppId:         appId,
-		Compress:      true,
+		ServerUrl:       serverUrl,
+		AppId:           appId,
+		Compress:        true,
 	}
 	return initBatchConsumer(config)
 }
@@ -75,10 +102,10 @@ func NewBatchConsumerWithBatchSize(serverUrl string, appId string, shuShuServerU
 	config := BatchConfig{
 		ShuShuServerUrl: shuShuServerUrl,
 		ShuShuAppId:     shuShuAppId,
-		ServerUrl:     serverUrl,
-		AppId:         appId,
-		Compress:      true,
-		BatchSize:     batchSize,
+		ServerUrl:       serverUrl,
+		AppId:           appId,
+		Compress:        true,
+		BatchSize:       batchSize,
 	}
 	return initBatchConsumer(config)
 }
@@ -91,9 +118,9 @@ func NewBatchConsumerWithCompress(serverUrl string, appId string, shuShuServerUr
 	config := BatchConfig{
 		ShuShuServerUrl: shuShuServerUrl,
 		ShuShuAppId:     shuShuAppId,
-		ServerUrl:     serverUrl,
-		AppId:         appId,
-		Compress:      compress,
+		ServerUrl:       serverUrl,
+		AppId:           appId,
+		Compress:        compress,
 	}
 	return initBatchConsumer(config)
 }
@@ -103,20 +130,21 @@ func NewBatchConsumerWithConfig(config BatchConfig) (Consumer, error) {
 }
 
 func initBatchConsumer(config BatchConfig) (Consumer, error) {
-	if config.ServerUrl == "" {
+	if config.ServerUrl == "" && len(config.Destinations) == 0 {
 		return nil, errors.New(fmt.Sprint("ServerUrl 不能为空"))
 	}
-	shushuUrl:=""
-	if config.ShuShuServerUrl!="" {
-		//数数的为可选
-		u, err := url.Parse(config.ShuShuServerUrl)
-		if err != nil {
-			return nil, err
-		}
-		u.Path = "/sync_server"
-		shushuUrl = u.String()
+	switch config.OverflowPolicy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowError:
+	case OverflowBlockTimeout:
+		return nil, errors.New("OverflowBlockTimeout is not supported by BatchConsumer.")
+	default:
+		return nil, errors.New("Unknown overflow policy.")
 	}
 
+	destinations, err := newDestinations(config)
+	if err != nil {
+		return nil, err
+	}
 
 	var batchSize int
 	if config.BatchSize > MaxBatchSize {
@@ -141,19 +169,46 @@ func initBatchConsumer(config BatchConfig) (Consumer, error) {
 		timeout = config.Timeout
 	}
 
+	retryPolicy := DefaultRetryPolicy()
+	if config.RetryPolicy != nil {
+		retryPolicy = config.RetryPolicy.withDefaults()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &BatchConsumer{
-		serverUrl:     config.ServerUrl,
-		appId:         config.AppId,
-		shuShuServerUrl: shushuUrl,
-		shuShuAppId:     config.ShuShuAppId,
-		timeout:       time.Duration(timeout) * time.Millisecond,
-		compress:      config.Compress,
-		bufferMutex:   new(sync.Mutex),
-		cacheMutex:    new(sync.Mutex),
-		batchSize:     batchSize,
-		buffer:        make([]Data, 0, batchSize),
-		cacheCapacity: cacheCapacity,
-		cacheBuffer:   make([][]Data, 0, cacheCapacity),
+		destinations:      destinations,
+		retryPolicy:       retryPolicy,
+		timeout:           time.Duration(timeout) * time.Millisecond,
+		compress:          config.Compress,
+		bufferMutex:       new(sync.Mutex),
+		batchSize:         batchSize,
+		buffer:            make([]Data, 0, batchSize),
+		cacheCapacity:     cacheCapacity,
+		async:             config.Async,
+		overflowPolicy:    config.OverflowPolicy,
+		queueMutex:        new(sync.RWMutex),
+		done:              make(chan struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
+		shutdownTimeout:   time.Duration(config.ShutdownTimeout) * time.Millisecond,
+		errorCallback:     config.OnError,
+		deliveredCallback: config.OnDelivered,
+	}
+
+	if c.async {
+		workers := config.Workers
+		if workers <= 0 {
+			workers = DefaultWorkers
+		}
+		queueSize := config.QueueSize
+		if queueSize <= 0 {
+			queueSize = DefaultQueueSize
+		}
+		c.queue = make(chan []Data, queueSize)
+		for i := 0; i < workers; i++ {
+			c.wg.Add(1)
+			go c.worker(c.queue)
+		}
 	}
 
 	var interval int
@@ -163,214 +218,485 @@ func initBatchConsumer(config BatchConfig) (Consumer, error) {
 		interval = config.Interval
 	}
 	if config.AutoFlush {
+		c.wg.Add(1)
 		go func() {
+			defer c.wg.Done()
 			ticker := time.NewTicker(time.Duration(interval) * time.Second)
 			defer ticker.Stop()
 			for {
-				<-ticker.C
-				_ = c.Flush()
+				select {
+				case <-ticker.C:
+					_ = c.FlushCtx(c.ctx)
+				case <-c.done:
+					return
+				}
 			}
-
 		}()
 	}
 	return c, nil
 }
 
 func (c *BatchConsumer) Add(d Data) error {
+	return c.AddCtx(context.Background(), d)
+}
+
+// AddCtx 与 Add 相同, 需要上报时 ctx 取消或超时会中断网络请求.
+// 异步模式下只会在队列已满且 OverflowPolicy 为 OverflowBlock 时阻塞
+func (c *BatchConsumer) AddCtx(ctx context.Context, d Data) error {
 	c.bufferMutex.Lock()
+	if c.closed {
+		c.bufferMutex.Unlock()
+		return ErrConsumerClosed
+	}
 	c.buffer = append(c.buffer, d)
+	if c.async {
+		batch := c.takeBuffer(false)
+		c.bufferMutex.Unlock()
+		if batch == nil {
+			return nil
+		}
+		return c.enqueue(ctx, batch)
+	}
+	//如果缓冲区数据溢出，或者缓存区有数据都要先上报. 判断需在持有锁时进行, 否则与其他 Go 程的 Add、Flush 存在竞争
+	needFlush := len(c.buffer) >= c.batchSize || c.queuedBatches() > 0
 	c.bufferMutex.Unlock()
-	if len(c.buffer) >= c.batchSize || len(c.cacheBuffer) > 0 {//如果缓冲区数据溢出，或者缓存区有数据都要先上报
-		err := c.Flush()
-		return err
+	if needFlush {
+		return c.FlushCtx(ctx)
 	}
 	return nil
 }
 
-func (c *BatchConsumer) Flush() error {
-	if len(c.buffer) == 0 && len(c.cacheBuffer) == 0 {
+// 取出缓冲区的数据, 缓冲区未满且 all 为 false 时返回 nil. 调用方需持有 bufferMutex
+func (c *BatchConsumer) takeBuffer(all bool) []Data {
+	if len(c.buffer) == 0 || (!all && len(c.buffer) < c.batchSize) {
 		return nil
 	}
+	batch := c.buffer
+	c.buffer = make([]Data, 0, c.batchSize)
+	return batch
+}
+
+// 将一批数据放入每个接收端的缓存区. 所有接收端共享同一批数据, 发送时只读.
+// 返回因缓存溢出被丢弃的数据, 调用方需在释放 bufferMutex 后调用 persist
+func (c *BatchConsumer) push(batch []Data) [][]Data {
+	var dropped [][]Data
+	for _, dest := range c.destinations {
+		dropped = append(dropped, dest.push(batch, c.cacheCapacity)...)
+	}
+	return dropped
+}
 
-	defer func() {
-		if len(c.cacheBuffer) > c.cacheCapacity {//如果缓存区数据达到上限，则抛弃第一块数据.不然网络一直错误将会造成阻塞
-			c.cacheBuffer = c.cacheBuffer[1:]
+// 将新加入缓存区的批次写入磁盘队列, 并回调被丢弃的数据. 写入磁盘需要同步, 调用方不能持有 bufferMutex
+func (c *BatchConsumer) persist(dropped [][]Data) {
+	for _, dest := range c.destinations {
+		dropped = append(dropped, dest.persist(c.cacheCapacity)...)
+	}
+	for _, data := range dropped {
+		c.onError(ErrCacheFull, data)
+	}
+}
+
+// 回调 OnError, 调用方不能持有锁, 以免回调中再次调用 Consumer 导致死锁
+func (c *BatchConsumer) onError(err error, data []Data) {
+	if c.errorCallback != nil {
+		c.errorCallback(err, data)
+	}
+}
+
+func (c *BatchConsumer) onDelivered(dest string, n int) {
+	if c.deliveredCallback != nil {
+		c.deliveredCallback(dest, n)
+	}
+}
+
+// 将一批数据放入异步队列, 队列已满时按 overflowPolicy 处理
+func (c *BatchConsumer) enqueue(ctx context.Context, batch []Data) error {
+	c.queueMutex.RLock()
+	defer c.queueMutex.RUnlock()
+	if c.queue == nil {
+		return ErrConsumerClosed
+	}
+
+	select {
+	case c.queue <- batch:
+		return nil
+	default:
+	}
+
+	switch c.overflowPolicy {
+	case OverflowDropNewest:
+		c.drop(ErrQueueFull, batch)
+		return nil
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.queue <- batch:
+				return nil
+			case old := <-c.queue:
+				c.drop(ErrQueueFull, old)
+			}
 		}
-	}()
+	case OverflowError:
+		c.drop(ErrQueueFull, batch)
+		return ErrQueueFull
+	default:
+		// 关闭时不再等待, 否则持有的读锁会阻塞 Shutdown
+		select {
+		case c.queue <- batch:
+			return nil
+		case <-ctx.Done():
+			c.drop(ctx.Err(), batch)
+			return ctx.Err()
+		case <-c.done:
+			if batch != nil {
+				c.drop(ErrConsumerClosed, batch)
+			}
+			return ErrConsumerClosed
+		}
+	}
+}
 
-	c.cacheMutex.Lock()
-	defer c.cacheMutex.Unlock()
-	c.bufferMutex.Lock()
-	if len(c.cacheBuffer) == 0 || len(c.buffer) >= c.batchSize {//如果缓存区没数据，获取缓冲区数据溢出，则将缓冲区数据存入缓存区
-		c.cacheBuffer = append(c.cacheBuffer, c.buffer)
-		c.buffer = make([]Data, 0, c.batchSize)
+// 记录未能放入异步队列而被丢弃的数据
+func (c *BatchConsumer) drop(err error, batch []Data) {
+	atomic.AddInt64(&c.dropped, int64(len(batch)))
+	c.onError(err, batch)
+}
+
+// 异步发送 Go 程, 将队列中的批次放入每个接收端的缓存区并发送. 不等待接收端的退避, 退避结束后再重发,
+// 一个接收端失败不会占用发送 Go 程. 关闭超时时立即退出, 队列中剩余的批次由 Shutdown 放弃
+func (c *BatchConsumer) worker(queue <-chan []Data) {
+	defer c.wg.Done()
+	var retry <-chan time.Time
+	for c.ctx.Err() == nil {
+		select {
+		case batch, ok := <-queue:
+			if !ok {
+				return
+			}
+			if batch != nil {
+				c.persist(c.push(batch))
+			}
+		case <-retry:
+		case <-c.ctx.Done():
+			return
+		}
+		for _, dest := range c.destinations {
+			_ = c.flushDestination(c.ctx, dest, false)
+		}
+		retry = nil
+		if d, ok := c.retryWait(); ok {
+			retry = time.After(d)
+		}
 	}
-	c.bufferMutex.Unlock()
+}
+
+// 有待发送数据的接收端中最早结束退避的等待时间, 没有待发送的数据时返回 false
+func (c *BatchConsumer) retryWait() (time.Duration, bool) {
+	var wait time.Duration
+	found := false
+	for _, dest := range c.destinations {
+		if dest.pending(true) == 0 {
+			continue
+		}
+		d := dest.retryWait()
+		if d < 0 {
+			d = 0
+		}
+		if !found || d < wait {
+			wait, found = d, true
+		}
+	}
+	return wait, found
+}
 
-	buffer := c.cacheBuffer[0]
+// Dropped 返回异步队列已满时被丢弃的数据条数
+func (c *BatchConsumer) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
 
-	jdata, err := json.Marshal(buffer)
-	if err == nil {
-		for i := 0; i < 3; i++ {
-			statusCode, code, _ := c.send(string(jdata), len(buffer))
-			if statusCode == 200 {
-				c.cacheBuffer = c.cacheBuffer[1:]//缓存区索引后移
-				switch code {
-				case 0:
-					return nil
-				case 1, -1:
-					return fmt.Errorf("herodataError:invalid data format")
-				case -2:
-					return fmt.Errorf("herodataError:APP ID doesn't exist")
-				case -3:
-					return fmt.Errorf("herodataError:invalid ip transmission")
+func (c *BatchConsumer) Flush() error {
+	return c.FlushCtx(context.Background())
+}
+
+// FlushCtx 向每个接收端上报一批数据, ctx 取消或超时会中断网络请求.
+// 各接收端独立发送和确认, 一个接收端失败不影响其他接收端. 接收端处于退避期间时跳过该接收端.
+// 异步模式下只将缓冲区数据交给发送 Go 程, 不等待发送结果
+func (c *BatchConsumer) FlushCtx(ctx context.Context) error {
+	if c.async {
+		c.bufferMutex.Lock()
+		batch := c.takeBuffer(true)
+		c.bufferMutex.Unlock()
+		if batch != nil {
+			return c.enqueue(ctx, batch)
+		}
+		// 没有新数据时通知发送 Go 程重发缓存区的数据, 队列已满说明发送 Go 程正忙, 无需通知
+		if c.pendingBatches() > 0 {
+			c.queueMutex.RLock()
+			defer c.queueMutex.RUnlock()
+			if c.queue != nil {
+				select {
+				case c.queue <- nil:
 				default:
-					return fmt.Errorf("herodataError:unknown error")
 				}
 			}
+		}
+		return nil
+	}
 
-			if c.shuShuServerUrl!="" {//如果配置了数数的地址
-				statusCode, code, err := c.sendToShuShu(string(jdata), len(buffer))
-				if statusCode == 200 {//缓存区索引后移
-					c.cacheBuffer = c.cacheBuffer[1:]
-					switch code {
-					case 0:
-						return nil
-					case 1, -1:
-						return fmt.Errorf("herodataError:invalid data format")
-					case -2:
-						return fmt.Errorf("herodataError:APP ID doesn't exist")
-					case -3:
-						return fmt.Errorf("herodataError:invalid ip transmission")
-					default:
-						return fmt.Errorf("herodataError:unknown error")
-					}
-				}
-				if err != nil {
-					if i == 2 {
-						return err
-					}
-				}
-			}
+	//如果缓存区没数据，或者缓冲区数据溢出，则将缓冲区数据存入每个接收端的缓存区.
+	//取出缓冲区和放入缓存区需在同一次加锁中完成, 否则并发的 Flush 会打乱批次顺序或重复判断缓存区为空
+	var dropped [][]Data
+	c.bufferMutex.Lock()
+	if batch := c.takeBuffer(c.queuedBatches() == 0); batch != nil {
+		dropped = c.push(batch)
+	}
+	c.bufferMutex.Unlock()
+	c.persist(dropped)
 
+	var errs []error
+	for _, dest := range c.destinations {
+		if err := c.flushDestination(ctx, dest, false); err != nil {
+			errs = append(errs, err)
 		}
 	}
-
-	return err
+	return errors.Join(errs...)
 }
 
-func (c *BatchConsumer) FlushAll() error {
-	for len(c.cacheBuffer) > 0 || len(c.buffer) > 0 {
-		if err := c.Flush(); err != nil {
-			if !strings.Contains(err.Error(), "herodataError") {
+// 向接收端发送其缓存区中第一批未在发送中的数据, 收到接收端的响应后才从缓存区移除.
+// 可重试的错误不在当前 Go 程中等待, 只记录接收端的退避时间, 退避期间直接返回最近一次的错误, 数据留在缓存区.
+// wait 为 true 时等待退避结束并继续重试, 直到收到响应或达到最大尝试次数
+func (c *BatchConsumer) flushDestination(ctx context.Context, dest *destination, wait bool) error {
+	for {
+		if d := dest.retryWait(); d > 0 {
+			if !wait {
+				return dest.pendingError()
+			}
+			if err := sleepCtx(ctx, d); err != nil {
 				return err
 			}
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := dest.next()
+		if err != nil {
+			c.onError(err, nil)
+			return err
+		}
+		if b == nil {
+			return nil
+		}
+		retry, err := c.sendBatch(ctx, dest, b)
+		if !retry || !wait {
+			return err
+		}
 	}
-	return nil
 }
 
-func (c *BatchConsumer) Close() error {
-	return c.FlushAll()
-}
-//推送数数
-func (c *BatchConsumer) sendToShuShu(data string, size int) (statusCode int, code int, err error) {
-	var encodedData string
-	var compressType = "gzip"
-	if c.compress {
-		encodedData, err = encodeData(data)
-	} else {
-		encodedData = data
-		compressType = "none"
-	}
-	if err != nil {
-		return 0, 0, err
-	}
-	postData := bytes.NewBufferString(encodedData)
-
-	var resp *http.Response
-	req, _ := http.NewRequest("POST", c.shuShuServerUrl, postData)
-	req.Header["appid"] = []string{c.shuShuAppId}
-	req.Header.Set("user-agent", "ta-go-sdk")
-	req.Header.Set("version", SdkVersion)
-	req.Header.Set("compress", compressType)
-	req.Header["TA-Integration-Type"] = []string{LibName}
-	req.Header["TA-Integration-Version"] = []string{SdkVersion}
-	req.Header["TA-Integration-Count"] = []string{strconv.Itoa(size)}
-	client := &http.Client{Timeout: c.timeout}
-	resp, err = client.Do(req)
+// 发送一批数据, 只尝试一次. 返回是否可以在退避结束后重试, 此时不回调 OnError, 数据保留在缓存区
+func (c *BatchConsumer) sendBatch(ctx context.Context, dest *destination, b *batch) (bool, error) {
+	defer dest.release(b)
+	buffer := b.data
 
+	jdata, err := json.Marshal(buffer)
 	if err != nil {
-		return 0, 0, err
+		return false, err
 	}
+	result, re := dest.deliver(ctx, string(jdata), len(buffer), c.timeout, c.compress, c.retryPolicy)
+	switch result {
+	case sendDelivered:
+		dest.done(b, nil) //缓存区索引后移
+		c.onDelivered(dest.name, len(buffer))
+		return false, nil
+	case sendRejected:
+		dest.done(b, re)
+		c.onError(re, buffer)
+		return false, re
+	case sendRetry:
+		return true, re
+	default:
+		// 达到最大尝试次数, 数据保留在缓存区, 等待下一次上报
+		c.onError(re, buffer)
+		return false, re
+	}
+}
 
-	defer resp.Body.Close()
+// 所有接收端中待发送的批次数, 不包含正在发送中的批次
+func (c *BatchConsumer) pendingBatches() int {
+	n := 0
+	for _, dest := range c.destinations {
+		n += dest.pending(true)
+	}
+	return n
+}
 
-	if resp.StatusCode == http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		var result struct {
-			Code int
-		}
+// 所有接收端缓存区中的批次数, 包含正在发送中的批次
+func (c *BatchConsumer) queuedBatches() int {
+	n := 0
+	for _, dest := range c.destinations {
+		n += dest.pending(false)
+	}
+	return n
+}
 
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			return resp.StatusCode, 1, err
-		}
+// Status 返回每个接收端的发送状态
+func (c *BatchConsumer) Status() []DestinationStatus {
+	result := make([]DestinationStatus, 0, len(c.destinations))
+	for _, dest := range c.destinations {
+		result = append(result, dest.snapshot())
+	}
+	return result
+}
 
-		return resp.StatusCode, result.Code, nil
-	} else {
-		return resp.StatusCode, -1, nil
+func (c *BatchConsumer) FlushAll() error {
+	return c.flushAll(context.Background())
+}
+
+// 在当前 Go 程中上报缓冲区和缓存区的所有数据, 不经过异步队列.
+// 各接收端并行发送, 一个接收端出现网络错误不影响其他接收端
+func (c *BatchConsumer) flushAll(ctx context.Context) error {
+	var dropped [][]Data
+	c.bufferMutex.Lock()
+	if batch := c.takeBuffer(true); batch != nil {
+		dropped = c.push(batch)
+	}
+	c.bufferMutex.Unlock()
+	c.persist(dropped)
+
+	errs := make([]error, len(c.destinations))
+	var wg sync.WaitGroup
+	for i, dest := range c.destinations {
+		wg.Add(1)
+		go func(i int, dest *destination) {
+			defer wg.Done()
+			errs[i] = c.drainDestination(ctx, dest)
+		}(i, dest)
 	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
+// 发送接收端缓存区中的所有数据, 遇到网络错误或 ctx 取消时返回
+func (c *BatchConsumer) drainDestination(ctx context.Context, dest *destination) error {
+	for dest.pending(true) > 0 {
+		if err := c.flushDestination(ctx, dest, true); err != nil {
+			if !isDropped(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-//
-func (c *BatchConsumer) send(data string, size int) (statusCode int, code int, err error) {
-	var encodedData string
-	var compressType = "gzip"
-	if c.compress {
-		encodedData, err = encodeData(data)
-	} else {
-		encodedData = data
-		compressType = "none"
+// ShutdownReport 关闭 BatchConsumer 的结果, 条数按接收端累计
+type ShutdownReport struct {
+	Delivered int64 // 关闭过程中被接收端确认的数据条数
+	Abandoned int64 // 关闭时仍未发送成功而被放弃的数据条数
+	Spilled   int64 // 关闭时仍未发送成功但已保存在磁盘队列中的数据条数, 下次启动时重新发送
+	Dropped   int64 // 运行期间因异步队列已满被丢弃的数据条数
+}
+
+func (c *BatchConsumer) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// CloseCtx 停止自动上传和异步发送 Go 程并上报所有剩余数据, ctx 取消或超时时放弃剩余数据并返回 ctx.Err()
+func (c *BatchConsumer) CloseCtx(ctx context.Context) error {
+	_, err := c.Shutdown(ctx)
+	return err
+}
+
+// Shutdown 与 CloseCtx 相同, 并返回关闭过程中发送成功和被放弃的数据条数.
+// 等待时间不超过 BatchConfig.ShutdownTimeout
+func (c *BatchConsumer) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+	c.bufferMutex.Lock()
+	if c.closed {
+		c.bufferMutex.Unlock()
+		return report, nil
 	}
-	if err != nil {
-		return 0, 0, err
-	}
-	postData := bytes.NewBufferString(encodedData)
-	var resp *http.Response
-	req, _ := http.NewRequest("POST", c.serverUrl, postData)
-	req.Header["appid"] = []string{c.appId}
-	req.Header.Set("user-agent", "hero-go-sdk")
-	req.Header.Set("version", SdkVersion)
-	req.Header.Set("compress", compressType)
-	req.Header["HERO-DATA-Integration-Type"] = []string{LibName}
-	req.Header["HERO-DATA-Integration-Version"] = []string{SdkVersion}
-	req.Header["HERO-DATA-Integration-Count"] = []string{strconv.Itoa(size)}
-	client := &http.Client{Timeout: c.timeout}
-	resp, err = client.Do(req)
+	c.closed = true
+	c.bufferMutex.Unlock()
 
-	if err != nil {
-		return 0, 0, err
+	if c.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.shutdownTimeout)
+		defer cancel()
 	}
+	delivered := c.delivered()
+
+	// 停止自动上传, 关闭异步队列并等待发送 Go 程处理完队列中的数据.
+	// 先关闭 done, 阻塞在队列上的 enqueue 会释放读锁
+	close(c.done)
+	c.queueMutex.Lock()
+	queue := c.queue
+	c.queue = nil
+	if queue != nil {
+		close(queue)
+	}
+	c.queueMutex.Unlock()
 
-	defer resp.Body.Close()
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
 
-	if resp.StatusCode == http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		var result struct {
-			Code int
+	var err error
+	var abandoned [][]Data
+	select {
+	case <-stopped:
+		err = c.flushAll(ctx)
+	case <-ctx.Done():
+		err = ctx.Err()
+		// 中断正在进行的发送, 等待后台 Go 程退出后, 队列中来不及处理的批次直接放弃
+		c.cancel()
+		<-stopped
+		for batch := range queue {
+			if batch == nil {
+				continue
+			}
+			for range c.destinations {
+				abandoned = append(abandoned, batch)
+			}
 		}
+	}
+	c.cancel()
 
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			return resp.StatusCode, 1, err
+	report.Delivered = c.delivered() - delivered
+	c.bufferMutex.Lock()
+	for range c.destinations {
+		abandoned = append(abandoned, c.buffer)
+	}
+	c.buffer = nil
+	c.bufferMutex.Unlock()
+	for _, dest := range c.destinations {
+		memory, spilled := dest.abandon()
+		abandoned = append(abandoned, memory...)
+		report.Spilled += spilled
+	}
+
+	cause := err
+	if cause == nil {
+		cause = ErrConsumerClosed
+	}
+	for _, data := range abandoned {
+		if len(data) > 0 {
+			report.Abandoned += int64(len(data))
+			c.onError(cause, data)
 		}
+	}
+	report.Dropped = c.Dropped()
+	return report, err
+}
 
-		return resp.StatusCode, result.Code, nil
-	} else {
-		return resp.StatusCode, -1, nil
+// 所有接收端已确认的数据条数
+func (c *BatchConsumer) delivered() int64 {
+	var n int64
+	for _, dest := range c.destinations {
+		n += dest.snapshot().Delivered
 	}
+	return n
 }
 
 // Gzip 压缩
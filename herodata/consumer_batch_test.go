@@ -0,0 +1,376 @@
+package herodata
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	stressGoroutines = flag.Int("batch.goroutines", 8, "TestBatchConsumerConcurrent: number of tracking goroutines")
+	stressEvents     = flag.Int("batch.events", 100, "TestBatchConsumerConcurrent: events per goroutine")
+	stressFailRate   = flag.Float64("batch.fail", 0.1, "TestBatchConsumerConcurrent: probability that the receiver answers 503")
+)
+
+// 模拟接收端, 随机返回 503, 记录每条数据被确认的次数
+type stressReceiver struct {
+	mutex    sync.Mutex
+	received map[string]int
+	failRate float64
+}
+
+func (r *stressReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("compress") == "gzip" {
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gr
+	}
+	var batch []Data
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if rand.Float64() < r.failRate {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	for _, d := range batch {
+		r.received[d.Properties["seq"].(string)]++
+	}
+	w.Write([]byte(`{"code":0}`))
+}
+
+// 检查每条数据恰好被确认一次
+func (r *stressReceiver) check(t *testing.T, name string, total int) {
+	t.Helper()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.received) != total {
+		t.Errorf("%s: received %d distinct events, want %d", name, len(r.received), total)
+	}
+	for seq, n := range r.received {
+		if n != 1 {
+			t.Errorf("%s: event %s received %d times", name, seq, n)
+		}
+	}
+}
+
+// 多个 Go 程并发 Track 和 Flush, 接收端随机失败, 检查每条数据被每个接收端恰好确认一次.
+// 使用 go test -race 运行可同时检查数据竞争, 可通过 -batch.events 等参数加大压力
+func TestBatchConsumerConcurrent(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		t.Run(fmt.Sprintf("async=%v", async), func(t *testing.T) {
+			goroutines, events := *stressGoroutines, *stressEvents
+			primary := &stressReceiver{received: map[string]int{}, failRate: *stressFailRate}
+			secondary := &stressReceiver{received: map[string]int{}, failRate: *stressFailRate}
+			primaryServer := httptest.NewServer(primary)
+			defer primaryServer.Close()
+			secondaryServer := httptest.NewServer(secondary)
+			defer secondaryServer.Close()
+
+			consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+				ServerUrl:     primaryServer.URL,
+				AppId:         "stress",
+				Destinations:  []DestinationConfig{{Name: "secondary", ServerUrl: secondaryServer.URL, AppId: "stress"}},
+				BatchSize:     7,
+				Compress:      true,
+				AutoFlush:     true,
+				Interval:      1,
+				CacheCapacity: goroutines * events,
+				Async:         async,
+				QueueSize:     4,
+				RetryPolicy:   &RetryPolicy{MaxAttempts: 10, BaseBackoff: 1, MaxBackoff: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ta := New(consumer)
+
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < events; i++ {
+						ta.Track(fmt.Sprintf("thread%d", g), "ABCDEF123456", "stress", map[string]interface{}{
+							"seq": fmt.Sprintf("%d-%d", g, i),
+						})
+						if i%50 == 0 {
+							ta.Flush()
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			report, err := consumer.(*BatchConsumer).Shutdown(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Abandoned != 0 || report.Dropped != 0 {
+				t.Fatalf("abandoned %d, dropped %d", report.Abandoned, report.Dropped)
+			}
+			primary.check(t, "primary", goroutines*events)
+			secondary.check(t, "secondary", goroutines*events)
+		})
+	}
+}
+
+// 关闭超时时中断后台 Go 程正在进行的发送, 并放弃所有未发送的数据
+func TestBatchConsumerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:       server.URL,
+		AppId:           "shutdown",
+		BatchSize:       2,
+		Async:           true,
+		Workers:         1,
+		QueueSize:       10,
+		CacheCapacity:   10,
+		ShutdownTimeout: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const events = 10
+	for i := 0; i < events; i++ {
+		if err := consumer.Add(Data{Type: "track", EventName: "e"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	report, err := consumer.(*BatchConsumer).Shutdown(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Shutdown took %s", elapsed)
+	}
+	if report.Delivered != 0 || report.Abandoned != events {
+		t.Fatalf("got %+v, want %d abandoned", report, events)
+	}
+}
+
+// 队列已满时阻塞的 Add 不会让 Shutdown 超过 ShutdownTimeout
+func TestBatchConsumerShutdownBlockedAdd(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:       server.URL,
+		AppId:           "blocked",
+		BatchSize:       1,
+		Async:           true,
+		Workers:         1,
+		QueueSize:       1,
+		ShutdownTimeout: 100,
+		OnError:         func(err error, data []Data) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := make(chan error, 1)
+	go func() {
+		for {
+			if err := consumer.Add(Data{Type: "track", EventName: "e"}); err != nil {
+				added <- err
+				return
+			}
+		}
+	}()
+	// 等待 Add 阻塞在已满的队列上
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	consumer.(*BatchConsumer).Shutdown(context.Background())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Shutdown took %s", elapsed)
+	}
+	select {
+	case err := <-added:
+		if !errors.Is(err, ErrConsumerClosed) {
+			t.Fatalf("got %v, want ErrConsumerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked Add did not return")
+	}
+}
+
+// 同步模式下发送失败后不在 Add 中等待, 返回错误, 退避期间的 Add 不再请求接收端
+func TestBatchConsumerSyncBackoff(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:   server.URL,
+		AppId:       "backoff",
+		BatchSize:   1,
+		RetryPolicy: &RetryPolicy{BaseBackoff: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		err := consumer.Add(Data{Type: "track", EventName: "e"})
+		var re *ReceiverError
+		if !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable || re.Dropped {
+			t.Fatalf("got %v, want ReceiverError with status 503", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Add took %s", elapsed)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 1 {
+		t.Fatalf("got %d requests, want 1", requests)
+	}
+	if status := consumer.(*BatchConsumer).Status(); status[0].Pending != 5 || status[0].LastError == nil {
+		t.Fatalf("got %+v", status[0])
+	}
+}
+
+// 不可重试的状态码直接丢弃数据, 不会每次上报都重发
+func TestBatchConsumerNonRetryableStatus(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	var failed int
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl: server.URL,
+		AppId:     "missing",
+		BatchSize: 1,
+		OnError:   func(err error, data []Data) { failed += len(data) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const events = 5
+	for i := 0; i < events; i++ {
+		err := consumer.Add(Data{Type: "track", EventName: "e"})
+		var re *ReceiverError
+		if !errors.As(err, &re) || !re.Dropped {
+			t.Fatalf("got %v, want dropped ReceiverError", err)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != events || failed != events {
+		t.Fatalf("got %d requests, %d failed events, want %d", requests, failed, events)
+	}
+	if status := consumer.(*BatchConsumer).Status(); status[0].Pending != 0 || status[0].Delivered != 0 {
+		t.Fatalf("got %+v", status[0])
+	}
+}
+
+// 异步模式下一个接收端不可用时, Add 不会阻塞, 其他接收端照常收到数据
+func TestBatchConsumerAsyncDestinationDown(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	healthy := &stressReceiver{received: map[string]int{}}
+	healthyServer := httptest.NewServer(healthy)
+	defer healthyServer.Close()
+
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:       down.URL,
+		AppId:           "down",
+		Destinations:    []DestinationConfig{{Name: "healthy", ServerUrl: healthyServer.URL, AppId: "down"}},
+		BatchSize:       1,
+		Async:           true,
+		Workers:         2,
+		QueueSize:       4,
+		ShutdownTimeout: 100,
+		OnError:         func(err error, data []Data) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	const events = 20
+	start := time.Now()
+	for i := 0; i < events; i++ {
+		if err := consumer.Add(Data{Type: "track", EventName: "e", Properties: map[string]interface{}{"seq": fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Add took %s", elapsed)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		healthy.mutex.Lock()
+		n := len(healthy.received)
+		healthy.mutex.Unlock()
+		if n == events {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("healthy destination received %d of %d events", n, events)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BatchConsumer 不支持 OverflowBlockTimeout 和未知的 OverflowPolicy
+func TestBatchConsumerOverflowPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlockTimeout, OverflowPolicy(99)} {
+		_, err := NewBatchConsumerWithConfig(BatchConfig{ServerUrl: "http://127.0.0.1:1", Async: true, OverflowPolicy: policy})
+		if err == nil {
+			t.Fatalf("want error for overflow policy %d", policy)
+		}
+	}
+}
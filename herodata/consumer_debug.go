@@ -2,111 +2,172 @@
 package herodata
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type DebugConsumer struct {
-	serverUrl     string // 接收端地址
-	appId         string // 项目 APP ID
-	shuShuServerUrl string //数数科技接口地址
-	shuShuAppId     string //
-	writeData bool // 是否写入TA库
+	name      string // 接收端名称, 用于错误信息和回调
+	serverUrl string // 接收端地址
+	appId     string // 项目 APP ID
+	writeData bool   // 是否写入TA库
+
+	errorCallback     func(err error, data []Data)
+	deliveredCallback func(dest string, n int)
+}
+
+type DebugConfig struct {
+	ServerUrl       string // 接收端地址
+	AppId           string // 项目 APP ID
+	ShuShuServerUrl string //数数科技接口地址, 设置后返回同时上报两个接收端的 MultiConsumer
+	ShuShuAppId     string //数数应用Id
+	WriteData       bool   // 是否写入TA库
+
+	OnError     func(err error, data []Data) // 上报失败时回调
+	OnDelivered func(dest string, n int)     // 数据被接收端确认时回调, dest 为接收端名称, n 为条数
 }
 
 // 创建 DebugConsumer. DebugConsumer 实现逐条上报数据，并返回数据校验的详细错误信息.
-func NewDebugConsumer(serverUrl string, appId string,shuShuServerUrl string, shuShuAppId string) (Consumer, error) {
-	return NewDebugConsumerWithWriter(serverUrl, appId,shuShuServerUrl, shuShuAppId, true)
+func NewDebugConsumer(serverUrl string, appId string, shuShuServerUrl string, shuShuAppId string) (Consumer, error) {
+	return NewDebugConsumerWithWriter(serverUrl, appId, shuShuServerUrl, shuShuAppId, true)
+}
+
+func NewDebugConsumerWithWriter(serverUrl string, appId string, shuShuServerUrl string, shuShuAppId string, writeData bool) (Consumer, error) {
+	config := DebugConfig{
+		ServerUrl:       serverUrl,
+		AppId:           appId,
+		ShuShuServerUrl: shuShuServerUrl,
+		ShuShuAppId:     shuShuAppId,
+		WriteData:       writeData,
+	}
+	return NewDebugConsumerWithConfig(config)
 }
-func NewDebugConsumerWithWriter( serverUrl string, appId string,shuShuServerUrl string, shuShuAppId string, writeData bool) (Consumer, error) {
-	if serverUrl == "" {
+
+func NewDebugConsumerWithConfig(config DebugConfig) (Consumer, error) {
+	if config.ServerUrl == "" {
 		return nil, errors.New("serverUrl不能为空")
 	}
-	u, err := url.Parse(shuShuServerUrl)
+	c := &DebugConsumer{
+		name:              "hero",
+		serverUrl:         config.ServerUrl,
+		appId:             config.AppId,
+		writeData:         config.WriteData,
+		errorCallback:     config.OnError,
+		deliveredCallback: config.OnDelivered,
+	}
+	if config.ShuShuServerUrl == "" {
+		return c, nil
+	}
+
+	//数数的为可选, 由 MultiConsumer 同时上报
+	u, err := url.Parse(config.ShuShuServerUrl)
 	if err != nil {
 		return nil, err
 	}
-
 	u.Path = "/data_debug"
-
-	c := &DebugConsumer{ serverUrl: serverUrl, appId: appId,shuShuServerUrl: u.String(), shuShuAppId: shuShuAppId, writeData: writeData}
-	return c, nil
+	shuShu := *c
+	shuShu.name = "shushu"
+	shuShu.serverUrl = u.String()
+	shuShu.appId = config.ShuShuAppId
+	return NewMultiConsumerWithConfig(MultiConfig{Targets: []MultiTarget{
+		{Name: c.name, Consumer: c},
+		{Name: shuShu.name, Consumer: &shuShu},
+	}})
 }
 
 func (c *DebugConsumer) Add(d Data) error {
+	return c.AddCtx(context.Background(), d)
+}
+
+// AddCtx 与 Add 相同, ctx 取消或超时会中断网络请求
+func (c *DebugConsumer) AddCtx(ctx context.Context, d Data) error {
 	jdata, err := json.Marshal(d)
 	if err != nil {
 		return err
 	}
 
-	return c.send(string(jdata))
+	if err := c.send(ctx, string(jdata)); err != nil {
+		if c.errorCallback != nil {
+			c.errorCallback(err, []Data{d})
+		}
+		return err
+	}
+	if c.deliveredCallback != nil {
+		c.deliveredCallback(c.name, 1)
+	}
+	return nil
 }
 
 func (c *DebugConsumer) Flush() error {
 	return nil
 }
 
+func (c *DebugConsumer) FlushCtx(ctx context.Context) error {
+	return ctx.Err()
+}
+
 func (c *DebugConsumer) Close() error {
 	return nil
 }
 
-func (c *DebugConsumer) send(data string) error {
+func (c *DebugConsumer) CloseCtx(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// 逐条发送数据, 接收端校验失败时返回 *ReceiverError, Code 为接收端返回的 errorLevel
+func (c *DebugConsumer) send(ctx context.Context, data string) error {
 	var dryRun = "0"
 	if !c.writeData {
 		dryRun = "1"
 	}
-	resp, err := http.PostForm(c.serverUrl, url.Values{"data": {data}, "appid": {c.appId}, "source": {"server"}, "dryRun": {dryRun}})
+	re := &ReceiverError{Destination: c.name, ServerUrl: c.serverUrl, BatchSize: 1}
+	resp, err := postForm(ctx, c.serverUrl, url.Values{"data": {data}, "appid": {c.appId}, "source": {"server"}, "dryRun": {dryRun}})
 	if err != nil {
-		return err
+		re.Err = &transportError{err: err}
+		return re
 	}
 
 	defer resp.Body.Close()
 
+	re.StatusCode = resp.StatusCode
 	if resp.StatusCode == http.StatusOK {
 		body, _ := ioutil.ReadAll(resp.Body)
-		result := map[string]interface{}{}
+		var result struct {
+			ErrorLevel int `json:"errorLevel"`
+		}
 		err = json.Unmarshal(body, &result)
 		if err != nil {
-			return err
+			re.Err = ErrInvalidData
+			re.Message = err.Error()
+			return re
 		}
-		if uint64(result["errorLevel"].(float64)) != 0 {
-			return errors.New(fmt.Sprintf("send to receiver failed with return content:  %s", string(body)))
+		if result.ErrorLevel != 0 {
+			re.Code = result.ErrorLevel
+			re.Dropped = true
+			re.Err = ErrInvalidData
+			re.Message = fmt.Sprintf("send to receiver failed with return content:  %s", string(body))
+			return re
 		}
 
 	} else {
-		return errors.New(fmt.Sprintf("Unexpected Status Code: %d", resp.StatusCode))
+		re.Err = ErrUnexpectedStatus
+		return re
 	}
 	return nil
 }
-func (c *DebugConsumer) sendToShuShu(data string) error {
-	var dryRun = "0"
-	if !c.writeData {
-		dryRun = "1"
-	}
-	resp, err := http.PostForm(c.shuShuServerUrl, url.Values{"data": {data}, "appid": {c.shuShuAppId}, "source": {"server"}, "dryRun": {dryRun}})
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		result := map[string]interface{}{}
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			return err
-		}
-		if uint64(result["errorLevel"].(float64)) != 0 {
-			return errors.New(fmt.Sprintf("send to receiver failed with return content:  %s", string(body)))
-		}
-
-	} else {
-		return errors.New(fmt.Sprintf("Unexpected Status Code: %d", resp.StatusCode))
+// 与 http.PostForm 相同, 但请求受 ctx 控制
+func postForm(ctx context.Context, serverUrl string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", serverUrl, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return http.DefaultClient.Do(req)
 }
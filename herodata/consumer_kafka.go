@@ -0,0 +1,424 @@
+// KafkaConsumer 将数据以 JSON 消息的形式写入 Kafka
+package herodata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KafkaCompression Kafka 消息的压缩方式
+type KafkaCompression string
+
+const (
+	KafkaCompressionNone   KafkaCompression = "none"
+	KafkaCompressionGzip   KafkaCompression = "gzip"
+	KafkaCompressionSnappy KafkaCompression = "snappy"
+	KafkaCompressionLz4    KafkaCompression = "lz4"
+	KafkaCompressionZstd   KafkaCompression = "zstd"
+)
+
+// KafkaAcks 写入成功前需要确认的副本数, 零值为 KafkaAcksAll.
+// 与 Kafka 协议中 acks 的取值不同, KafkaProducerConfig.RequiredAcks 中为协议的取值
+type KafkaAcks int
+
+const (
+	KafkaAcksAll    KafkaAcks = 0 // 所有同步副本写入后确认, 默认
+	KafkaAcksLeader KafkaAcks = 1 // leader 写入后确认
+	KafkaAcksNone   KafkaAcks = 2 // 不等待确认, 可能丢失数据
+)
+
+// Kafka 协议中 acks 的取值
+func (a KafkaAcks) protocolValue() int {
+	switch a {
+	case KafkaAcksLeader:
+		return 1
+	case KafkaAcksNone:
+		return 0
+	default:
+		return -1
+	}
+}
+
+const (
+	DefaultKafkaBatchSize     = 100         // 默认每批发送 100 条
+	DefaultKafkaFlushInterval = time.Second // 默认缓冲区中的数据最多等待 1 秒
+)
+
+// KafkaMessage 发送到 Kafka 的一条消息
+type KafkaMessage struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// KafkaProducer 向 Kafka 发送消息. SDK 不依赖 Kafka 客户端库,
+// 可基于 segmentio/kafka-go、IBM/sarama 等实现该接口, 测试时可使用内存中的实现.
+// Produce 在所有消息被确认后返回; 部分消息失败时返回 *KafkaDeliveryError
+type KafkaProducer interface {
+	Produce(ctx context.Context, messages []KafkaMessage) error
+	Close() error
+}
+
+// KafkaProducerConfig 创建 KafkaProducer 时使用的配置, 由 KafkaConfig 中的同名字段得到
+type KafkaProducerConfig struct {
+	Brokers      []string
+	Topic        string
+	Compression  KafkaCompression
+	RequiredAcks int // Kafka 协议中 acks 的取值: -1 所有同步副本, 1 leader, 0 不等待确认
+	BatchSize    int
+	Timeout      time.Duration
+}
+
+// KafkaDeliveryError 一批消息中部分消息发送失败. Errs 与发送的消息一一对应, nil 表示该消息已被确认
+type KafkaDeliveryError struct {
+	Errs []error
+}
+
+func (e *KafkaDeliveryError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			failed++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return fmt.Sprintf("kafka: %d of %d messages failed: %s", failed, len(e.Errs), first)
+}
+
+func (e *KafkaDeliveryError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+type KafkaConfig struct {
+	Brokers      []string         // Kafka 地址, 只传给 NewProducer, 设置 Producer 时不能设置
+	Topic        string           // 写入的 topic
+	Compression  KafkaCompression // 压缩方式, 默认 KafkaCompressionNone. 只传给 NewProducer, 设置 Producer 时不能设置
+	RequiredAcks KafkaAcks        // 需要确认的副本数, 默认 KafkaAcksAll. 只传给 NewProducer, 设置 Producer 时不能设置
+	Timeout      int              // 每次发送的超时时间, 单位毫秒, 默认 DefaultTimeOut
+
+	// 创建 KafkaProducer, 与 Producer 二选一. 参数为上面的配置
+	NewProducer func(config KafkaProducerConfig) (KafkaProducer, error)
+	Producer    KafkaProducer // 已创建的 KafkaProducer, 关闭 KafkaConsumer 时一起关闭. 地址、压缩和确认方式由创建时的配置决定
+
+	// 消息的 key, 默认使用 #account_id, 为空时使用 #distinct_id, 同一用户的数据写入同一分区
+	KeyFunc func(d Data) []byte
+
+	BatchSize     int           // 每批发送的条数, 默认 DefaultKafkaBatchSize
+	FlushInterval time.Duration // 缓冲区中的数据最长等待时间, 默认 DefaultKafkaFlushInterval
+
+	RetryPolicy *RetryPolicy // 发送失败后的重试策略, 为 nil 时使用 DefaultRetryPolicy. 只重试失败的消息
+
+	OnError     func(err error, data []Data) // 重试后仍然发送失败时回调, data 为失败的数据
+	OnDelivered func(dest string, n int)     // 数据被 Kafka 确认时回调, dest 为 kafka:topic
+}
+
+type KafkaConsumer struct {
+	producer    KafkaProducer
+	topic       string
+	name        string // 监控指标和回调中使用的名称
+	keyFunc     func(d Data) []byte
+	timeout     time.Duration
+	retryPolicy RetryPolicy
+
+	bufferMutex sync.Mutex // 保护 buffer 和 closed
+	buffer      []Data
+	batchSize   int
+	closed      bool
+	sendMutex   sync.Mutex // 同一时间只有一个 Go 程发送, 保证数据的顺序
+
+	done   chan struct{}
+	ctx    context.Context    // 定时发送使用的 ctx, 关闭超时时取消
+	cancel context.CancelFunc // 取消 ctx
+	wg     sync.WaitGroup
+
+	errorCallback     func(err error, data []Data)
+	deliveredCallback func(dest string, n int)
+}
+
+// 创建 KafkaConsumer, 缓冲区满或每隔 FlushInterval 发送一批数据
+func NewKafkaConsumerWithConfig(config KafkaConfig) (Consumer, error) {
+	if config.Topic == "" {
+		return nil, errors.New("Topic can not be empty.")
+	}
+	switch config.Compression {
+	case "", KafkaCompressionNone, KafkaCompressionGzip, KafkaCompressionSnappy, KafkaCompressionLz4, KafkaCompressionZstd:
+	default:
+		return nil, fmt.Errorf("Unknown kafka compression %q.", config.Compression)
+	}
+	switch config.RequiredAcks {
+	case KafkaAcksNone, KafkaAcksLeader, KafkaAcksAll:
+	default:
+		return nil, fmt.Errorf("Unknown kafka required acks %d.", config.RequiredAcks)
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultKafkaBatchSize
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeOut
+	}
+	flushInterval := config.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultKafkaFlushInterval
+	}
+	retryPolicy := DefaultRetryPolicy()
+	if config.RetryPolicy != nil {
+		retryPolicy = config.RetryPolicy.withDefaults()
+	}
+
+	producer := config.Producer
+	switch {
+	case producer != nil && config.NewProducer != nil:
+		return nil, errors.New("Producer and NewProducer can not be both set.")
+	case producer == nil && config.NewProducer == nil:
+		return nil, errors.New("Producer or NewProducer is required.")
+	case producer != nil && (len(config.Brokers) > 0 || config.Compression != "" || config.RequiredAcks != KafkaAcksAll):
+		// 这些配置只在创建 KafkaProducer 时使用, 设置了 Producer 时不会生效
+		return nil, errors.New("Brokers, Compression and RequiredAcks can not be set with Producer.")
+	case producer == nil:
+		compression := config.Compression
+		if compression == "" {
+			compression = KafkaCompressionNone
+		}
+		var err error
+		producer, err = config.NewProducer(KafkaProducerConfig{
+			Brokers:      config.Brokers,
+			Topic:        config.Topic,
+			Compression:  compression,
+			RequiredAcks: config.RequiredAcks.protocolValue(),
+			BatchSize:    batchSize,
+			Timeout:      time.Duration(timeout) * time.Millisecond,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = defaultKafkaKey
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &KafkaConsumer{
+		producer:          producer,
+		topic:             config.Topic,
+		name:              "kafka:" + config.Topic,
+		keyFunc:           keyFunc,
+		timeout:           time.Duration(timeout) * time.Millisecond,
+		retryPolicy:       retryPolicy,
+		buffer:            make([]Data, 0, batchSize),
+		batchSize:         batchSize,
+		done:              make(chan struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
+		errorCallback:     config.OnError,
+		deliveredCallback: config.OnDelivered,
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = c.FlushCtx(c.ctx)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// 默认的消息 key: #account_id, 为空时使用 #distinct_id
+func defaultKafkaKey(d Data) []byte {
+	if d.AccountId != "" {
+		return []byte(d.AccountId)
+	}
+	if d.DistinctId != "" {
+		return []byte(d.DistinctId)
+	}
+	return nil
+}
+
+func (c *KafkaConsumer) Add(d Data) error {
+	return c.AddCtx(context.Background(), d)
+}
+
+// AddCtx 将数据加入缓冲区, 缓冲区满时发送, ctx 取消或超时会中断发送和重试
+func (c *KafkaConsumer) AddCtx(ctx context.Context, d Data) error {
+	c.bufferMutex.Lock()
+	if c.closed {
+		c.bufferMutex.Unlock()
+		return ErrConsumerClosed
+	}
+	c.buffer = append(c.buffer, d)
+	needFlush := len(c.buffer) >= c.batchSize
+	c.bufferMutex.Unlock()
+	if needFlush {
+		return c.FlushCtx(ctx)
+	}
+	return nil
+}
+
+func (c *KafkaConsumer) Flush() error {
+	return c.FlushCtx(context.Background())
+}
+
+// FlushCtx 发送缓冲区中的所有数据, 重试后仍然失败的数据回调 OnError 并返回错误
+func (c *KafkaConsumer) FlushCtx(ctx context.Context) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	c.bufferMutex.Lock()
+	batch := c.buffer
+	c.buffer = make([]Data, 0, c.batchSize)
+	c.bufferMutex.Unlock()
+
+	var errs []error
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > c.batchSize {
+			n = c.batchSize
+		}
+		if err := c.send(ctx, batch[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		batch = batch[n:]
+	}
+	return errors.Join(errs...)
+}
+
+// 发送一批数据, 失败时按重试策略只重试失败的消息
+func (c *KafkaConsumer) send(ctx context.Context, batch []Data) error {
+	messages := make([]KafkaMessage, 0, len(batch))
+	data := make([]Data, 0, len(batch))
+	var invalid []Data
+	for _, d := range batch {
+		value, err := json.Marshal(d)
+		if err != nil {
+			invalid = append(invalid, d)
+			continue
+		}
+		messages = append(messages, KafkaMessage{Topic: c.topic, Key: c.keyFunc(d), Value: value})
+		data = append(data, d)
+	}
+	var invalidErr error
+	if len(invalid) > 0 {
+		invalidErr = fmt.Errorf("%w: %s", ErrInvalidData, c.name)
+		c.onError(invalidErr, invalid)
+	}
+
+	for attempt := 1; len(messages) > 0; attempt++ {
+		if err := ctx.Err(); err != nil {
+			c.onError(err, data)
+			return err
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		start := time.Now()
+		err := c.producer.Produce(sendCtx, messages)
+		cancel()
+		metrics().Histogram(MetricSendLatency, time.Since(start).Seconds(), c.name)
+
+		// 只保留失败的消息, 其余的已被确认
+		sent := len(messages)
+		var de *KafkaDeliveryError
+		switch {
+		case err == nil:
+			messages, data = nil, nil
+		case errors.As(err, &de) && len(de.Errs) == len(messages):
+			var failedMessages []KafkaMessage
+			var failedData []Data
+			for i, e := range de.Errs {
+				if e != nil {
+					failedMessages = append(failedMessages, messages[i])
+					failedData = append(failedData, data[i])
+				}
+			}
+			messages, data = failedMessages, failedData
+		}
+		if delivered := sent - len(messages); delivered > 0 {
+			c.onDelivered(c.name, delivered)
+		}
+		if len(messages) == 0 {
+			metrics().Counter(MetricBatchesSent, 1, c.name)
+			return invalidErr
+		}
+
+		if attempt >= c.retryPolicy.MaxAttempts {
+			metrics().Counter(MetricBatchesFailed, 1, c.name)
+			err = fmt.Errorf("%s: %w", c.name, err)
+			c.onError(err, data)
+			return err
+		}
+		metrics().Counter(MetricRetries, 1, c.name)
+		if e := sleepCtx(ctx, c.retryPolicy.backoff(attempt, 0)); e != nil {
+			c.onError(e, data)
+			return e
+		}
+	}
+	return invalidErr
+}
+
+func (c *KafkaConsumer) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// CloseCtx 发送缓冲区中剩余的数据并关闭 KafkaProducer, ctx 取消或超时时放弃剩余数据
+func (c *KafkaConsumer) CloseCtx(ctx context.Context) error {
+	c.bufferMutex.Lock()
+	if c.closed {
+		c.bufferMutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.bufferMutex.Unlock()
+
+	// 等待正在进行的定时发送, ctx 取消或超时时中断
+	close(c.done)
+	stopped := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		c.cancel()
+		<-stopped
+	}
+	c.cancel()
+
+	err := c.FlushCtx(ctx)
+	if e := c.producer.Close(); e != nil {
+		err = errors.Join(err, fmt.Errorf("%s: close: %w", c.name, e))
+	}
+	return err
+}
+
+// 回调 OnError, 未设置时打印到标准错误输出
+func (c *KafkaConsumer) onError(err error, data []Data) {
+	reportError(c.errorCallback, err, data)
+}
+
+func (c *KafkaConsumer) onDelivered(dest string, n int) {
+	if c.deliveredCallback != nil {
+		c.deliveredCallback(dest, n)
+	}
+}
@@ -1,12 +1,14 @@
 package herodata
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,28 +18,146 @@ const (
 	ChannelSize              = 1000 // channel 缓冲区
 	ROTATE_DAILY  RotateMode = 0    // 按天切分
 	ROTATE_HOURLY RotateMode = 1    // 按小时切分
+	ROTATE_SIZE   RotateMode = 2    // 只按文件大小切分, 需要设置 FileSize
+)
+
+// SyncPolicy 日志文件同步到磁盘(fsync)的策略, 由写入 Go 程执行
+type SyncPolicy int32
+
+const (
+	SyncNever    SyncPolicy = 0 // 由操作系统决定何时落盘, 仅在 Flush 和 Close 时同步
+	SyncEveryN   SyncPolicy = 1 // 每写入 SyncEvery 条同步一次
+	SyncInterval SyncPolicy = 2 // 每隔 SyncInterval 同步一次
+	SyncAlways   SyncPolicy = 3 // 每条数据写入后同步
+)
+
+// MultiProcessMode 多个进程写入同一日志目录时的处理方式
+type MultiProcessMode int32
+
+const (
+	MultiProcessNone       MultiProcessMode = 0 // 只有一个进程写入该目录
+	MultiProcessLock       MultiProcessMode = 1 // 写入和切分时持有目录中的文件锁(flock), 多个进程写入同一组文件
+	MultiProcessUniqueName MultiProcessMode = 2 // 文件名中加入进程号, 每个进程写入各自的文件
+)
+
+// 信道中的一项. done 不为空时为 Flush 的屏障, 写入 Go 程处理到该项时同步所有文件并回复
+type logEntry struct {
+	line *bytes.Buffer // JSON 数据和换行符, 写入后放回 linePool
+	done chan error
+}
+
+var linePool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func putLine(line *bytes.Buffer) {
+	if line.Cap() <= 64*1024 { // 过大的缓冲区不复用, 避免长期占用内存
+		line.Reset()
+		linePool.Put(line)
+	}
+}
+
+const (
+	DefaultSyncEvery    = 1000        // SyncEveryN 模式下默认每 1000 条同步一次
+	DefaultSyncInterval = time.Second // SyncInterval 模式下默认每秒同步一次
+)
+
+const (
+	DefaultBufferSize    = 64 * 1024   // 默认写缓冲区 64KB
+	DefaultFlushInterval = time.Second // 默认每秒至少将写缓冲区写入文件一次
+)
+
+const (
+	DefaultBlockTimeout = 100   // 默认阻塞超时时长 100 毫秒
+	DefaultMaxBuffered  = 10000 // 写入失败期间默认最多暂存 10000 条数据
 )
 
 type LogConsumer struct {
-	directory      string      // 日志文件存放目录
-	dateFormat     string      // 与日志切分有关的时间格式
-	fileSize       int64       // 单个日志文件大小，单位 Byte
-	fileNamePrefix string      // 日志文件前缀名
-	currentFile    *os.File    // 当前日志文件
-	ch             chan string // 数据传输信道
-	wg             sync.WaitGroup
-	secondDir      string   //如果不为空则会保存2份日志，用于推送多个端的时候
-	secondFile     *os.File // 第二个日志文件句柄
+	directory   string          // 日志文件存放目录, 未设置时为第一个 Sinks 的目录
+	sinkConfigs []LogSinkConfig // 所有日志输出目录的配置
+	ch          chan logEntry   // 数据传输信道
+	wg          sync.WaitGroup
+
+	overflowPolicy OverflowPolicy // 信道已满时的处理方式
+	blockTimeout   time.Duration  // OverflowBlockTimeout 模式下的最长阻塞时间
+	dropped        int64          // 因信道已满被丢弃的条数
+	chMutex        sync.RWMutex   // 保护 ch 的关闭, Add 持有读锁
+	closed         bool
+	stopped        chan struct{} // 写入 Go 程退出时关闭
+
+	sinks       []*logSink       // 日志输出目录, 与 sinkConfigs 一一对应
+	now         func() time.Time // 当前时间, 决定文件切分
+	retryPolicy RetryPolicy      // 打开或写入文件失败后的重试间隔
+	maxBuffered int              // 每个目录降级期间最多暂存的条数
+	healthMutex sync.Mutex       // 保护 sinks 中的 health 和 active
+	rotated     chan struct{}    // 文件切分后通知后台清理 Go 程
+
+	syncPolicy   SyncPolicy    // 同步到磁盘的策略
+	syncEvery    int           // SyncEveryN 模式下每写入多少条同步一次
+	syncInterval time.Duration // SyncInterval 模式下的同步间隔
+
+	bufferSize    int           // 每个目录的写缓冲区大小
+	flushInterval time.Duration // 写缓冲区写入文件的最长间隔
+
+	multiProcess MultiProcessMode // 多进程写入同一目录时的处理方式
+
+	errorCallback     func(err error, data []Data)
+	deliveredCallback func(dest string, n int)
 }
 
 type LogConfig struct {
 	Directory      string     // 日志文件存放目录
 	RotateMode     RotateMode // 与日志切分有关的时间格式
-	FileSize       int        // 单个日志文件大小，单位 Byte
+	FileSize       int        // 单个日志文件大小，单位 MB, 0 表示不按大小切分
 	FileNamePrefix string     // 日志文件前缀名
 	AutoFlush      bool       // 自动上传
 	Interval       int        // 自动上传间隔
 	SecondDir      string     //如果不为空则会保存2份日志，用于推送多个端的时候
+
+	RotateInterval   time.Duration  // 按时间切分的间隔, 如 5 * time.Minute, 按当天零点对齐. 设置后忽略 RotateMode
+	FileNameTemplate string         // 文件名模板, 可使用 {prefix} {time} {index} {hostname} {pid} {appid}, 默认为 前缀.log.{time}_{index}
+	AppId            string         // 文件名模板中 {appid} 的值
+	Location         *time.Location // 计算切分时间段和文件名中时间使用的时区, 默认为本地时区. 应与 TDAnalyticsConfig.Location 一致
+
+	// 其他日志输出目录, 每条数据在每个目录中各写一份, 用于推送到多个端.
+	// 每个目录可以单独设置前缀名、切分模式和文件大小. 设置了 Sinks 时 Directory 可以为空
+	Sinks []LogSinkConfig
+
+	Retention LogRetention // Directory 和 SecondDir 中旧文件的压缩和保留策略, 默认不压缩且一直保留
+
+	ChannelSize    int            // 信道容量, 默认 ChannelSize
+	OverflowPolicy OverflowPolicy // 信道已满时的处理方式, 默认阻塞
+	BlockTimeout   int            // OverflowBlockTimeout 模式下的最长阻塞时间, 单位毫秒, 默认 DefaultBlockTimeout
+
+	RetryPolicy *RetryPolicy // 打开或写入文件失败后的重试间隔, 为 nil 时使用 DefaultRetryPolicy. 忽略 MaxAttempts, 一直重试到成功
+	MaxBuffered int          // 写入失败期间每个目录最多暂存在内存中的条数, 默认 DefaultMaxBuffered, 超出后丢弃最早的数据
+
+	SyncPolicy   SyncPolicy    // 同步到磁盘的策略, 默认 SyncNever
+	SyncEvery    int           // SyncEveryN 模式下每写入多少条同步一次, 默认 DefaultSyncEvery
+	SyncInterval time.Duration // SyncInterval 模式下的同步间隔, 默认 DefaultSyncInterval
+
+	// 数据先写入缓冲区, 缓冲区满、信道中没有待写入的数据或距上次写入超过 BufferFlushInterval 时写入文件
+	BufferSize          int           // 每个目录的写缓冲区大小, 单位 Byte, 默认 DefaultBufferSize
+	BufferFlushInterval time.Duration // 缓冲区写入文件的最长间隔, 默认 DefaultFlushInterval
+
+	// 多个进程写入同一目录时的处理方式, 默认 MultiProcessNone. 缓冲区中只有完整的行, 每次以 O_APPEND 方式整体写入,
+	// MultiProcessLock 模式下写入在文件锁内完成, 各进程的数据行不会交错
+	MultiProcess MultiProcessMode
+
+	OnError     func(err error, data []Data) // 写入文件失败时回调, 未设置时打印到标准错误输出
+	OnDelivered func(dest string, n int)     // 数据写入文件后回调, dest 为日志目录, n 为条数
+}
+
+// LogSinkConfig 日志输出目录的配置, 各字段含义与 LogConfig 中的同名字段相同
+type LogSinkConfig struct {
+	Directory      string     // 日志文件存放目录
+	RotateMode     RotateMode // 切分模式
+	FileSize       int        // 单个日志文件大小，单位 MB, 0 表示不按大小切分
+	FileNamePrefix string     // 日志文件前缀名
+
+	RotateInterval   time.Duration // 按时间切分的间隔, 设置后忽略 RotateMode
+	FileNameTemplate string        // 文件名模板
+	AppId            string        // 文件名模板中 {appid} 的值
+
+	Retention LogRetention // 旧文件的压缩和保留策略
 }
 
 // 创建 LogConsumer. 传入日志目录和切分模式
@@ -60,183 +180,319 @@ func NewLogConsumerWithFileSize(directory string, r RotateMode, secondDir string
 }
 
 func NewLogConsumerWithConfig(config LogConfig) (Consumer, error) {
-	if config.Directory == config.SecondDir {
-		return nil, errors.New("the two directories can not be  same.")
-	}
-	var df string
-	switch config.RotateMode {
-	case ROTATE_DAILY:
-		df = "2006-01-02"
-	case ROTATE_HOURLY:
-		df = "2006-01-02-15"
+	var sinkConfigs []LogSinkConfig
+	for _, dir := range []string{config.Directory, config.SecondDir} {
+		if dir == "" {
+			continue
+		}
+		sinkConfigs = append(sinkConfigs, LogSinkConfig{
+			Directory:        dir,
+			RotateMode:       config.RotateMode,
+			FileSize:         config.FileSize,
+			FileNamePrefix:   config.FileNamePrefix,
+			RotateInterval:   config.RotateInterval,
+			FileNameTemplate: config.FileNameTemplate,
+			AppId:            config.AppId,
+			Retention:        config.Retention,
+		})
+	}
+	sinkConfigs = append(sinkConfigs, config.Sinks...)
+	if len(sinkConfigs) == 0 {
+		return nil, errors.New("directory can not be empty.")
+	}
+	switch config.MultiProcess {
+	case MultiProcessNone:
+	case MultiProcessLock:
+		if !flockSupported {
+			return nil, errors.New("MultiProcessLock is not supported on this platform.")
+		}
+	case MultiProcessUniqueName:
+		for i := range sinkConfigs {
+			sinkConfigs[i].FileNameTemplate = uniqueFileNameTemplate(sinkConfigs[i])
+		}
 	default:
-		return nil, errors.New("Unknown rotate mode.")
+		return nil, errors.New("Unknown multi process mode.")
+	}
+	switch config.OverflowPolicy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowError, OverflowBlockTimeout:
+	default:
+		return nil, errors.New("Unknown overflow policy.")
+	}
+	for i, sink := range sinkConfigs {
+		if sink.Directory == "" {
+			return nil, errors.New("directory can not be empty.")
+		}
+		if _, err := newRotator(sink, nil); err != nil {
+			return nil, err
+		}
+		for _, other := range sinkConfigs[:i] {
+			if filepath.Clean(other.Directory) == filepath.Clean(sink.Directory) {
+				return nil, errors.New("the two directories can not be  same.")
+			}
+		}
+	}
+
+	channelSize := config.ChannelSize
+	if channelSize <= 0 {
+		channelSize = ChannelSize
+	}
+	blockTimeout := config.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+	retryPolicy := DefaultRetryPolicy()
+	if config.RetryPolicy != nil {
+		retryPolicy = config.RetryPolicy.withDefaults()
+	}
+	maxBuffered := config.MaxBuffered
+	if maxBuffered <= 0 {
+		maxBuffered = DefaultMaxBuffered
+	}
+	syncEvery := config.SyncEvery
+	if syncEvery <= 0 {
+		syncEvery = DefaultSyncEvery
+	}
+	syncInterval := config.SyncInterval
+	if syncInterval <= 0 {
+		syncInterval = DefaultSyncInterval
+	}
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	flushInterval := config.BufferFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
 	}
 
 	c := &LogConsumer{
-		directory:      config.Directory,
-		dateFormat:     df,
-		fileSize:       int64(config.FileSize * 1024 * 1024),
-		fileNamePrefix: config.FileNamePrefix,
-		ch:             make(chan string, ChannelSize),
-		secondDir:      config.SecondDir,
+		directory:         sinkConfigs[0].Directory,
+		sinkConfigs:       sinkConfigs,
+		ch:                make(chan logEntry, channelSize),
+		overflowPolicy:    config.OverflowPolicy,
+		blockTimeout:      time.Duration(blockTimeout) * time.Millisecond,
+		stopped:           make(chan struct{}),
+		retryPolicy:       retryPolicy,
+		now:               time.Now,
+		maxBuffered:       maxBuffered,
+		syncPolicy:        config.SyncPolicy,
+		syncEvery:         syncEvery,
+		syncInterval:      syncInterval,
+		bufferSize:        bufferSize,
+		flushInterval:     flushInterval,
+		multiProcess:      config.MultiProcess,
+		errorCallback:     config.OnError,
+		deliveredCallback: config.OnDelivered,
+	}
+	if loc := config.Location; loc != nil {
+		c.now = func() time.Time { return time.Now().In(loc) }
 	}
 	return c, c.init()
 }
 
 func (c *LogConsumer) Add(d Data) error {
-	bdata, err := json.Marshal(d)
-	if err != nil {
+	return c.AddCtx(context.Background(), d)
+}
+
+// AddCtx 与 Add 相同, 信道已满时按 OverflowPolicy 处理. 阻塞时 ctx 取消或超时会放弃写入并返回 ctx.Err().
+// 写入 Go 程已退出时返回 ErrConsumerClosed
+func (c *LogConsumer) AddCtx(ctx context.Context, d Data) error {
+	line := linePool.Get().(*bytes.Buffer)
+	if err := json.NewEncoder(line).Encode(d); err != nil {
+		putLine(line)
 		return err
 	}
+	entry := logEntry{line: line}
 
-	c.ch <- string(bdata)
-	return nil
+	c.chMutex.RLock()
+	defer c.chMutex.RUnlock()
+	if c.closed {
+		return ErrConsumerClosed
+	}
+
+	select {
+	case c.ch <- entry:
+		metrics().Gauge(MetricLogChannelDepth, float64(len(c.ch)), c.directory)
+		return nil
+	case <-c.stopped:
+		return ErrConsumerClosed
+	default:
+	}
+
+	switch c.overflowPolicy {
+	case OverflowDropNewest:
+		c.drop(ErrQueueFull, line.Bytes())
+		putLine(line)
+		return nil
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.ch <- entry:
+				return nil
+			case old := <-c.ch:
+				if old.done != nil {
+					old.done <- ErrQueueFull // Flush 的屏障被挤出信道
+				} else {
+					c.drop(ErrQueueFull, old.line.Bytes())
+					putLine(old.line)
+				}
+			case <-c.stopped:
+				return ErrConsumerClosed
+			}
+		}
+	case OverflowError:
+		c.drop(ErrQueueFull, line.Bytes())
+		putLine(line)
+		return ErrQueueFull
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(c.blockTimeout)
+		defer timer.Stop()
+		select {
+		case c.ch <- entry:
+			return nil
+		case <-c.stopped:
+			return ErrConsumerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			c.drop(ErrQueueFull, line.Bytes())
+			putLine(line)
+			return ErrQueueFull
+		}
+	default:
+		select {
+		case c.ch <- entry:
+			return nil
+		case <-c.stopped:
+			return ErrConsumerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
+// 记录因信道或暂存区已满被丢弃的数据
+func (c *LogConsumer) drop(err error, line []byte) {
+	atomic.AddInt64(&c.dropped, 1)
+	if c.errorCallback != nil {
+		c.onError(err, line)
+	}
+}
+
+// Dropped 返回因信道或暂存区已满被丢弃的数据条数
+func (c *LogConsumer) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Flush 等待之前写入的数据都已写入文件并同步到磁盘. 有目录处于降级状态时返回 ErrLogUnavailable
 func (c *LogConsumer) Flush() error {
-	if err := c.currentFile.Sync(); err != nil {
+	return c.FlushCtx(context.Background())
+}
+
+// FlushCtx 与 Flush 相同, ctx 取消或超时时停止等待
+func (c *LogConsumer) FlushCtx(ctx context.Context) error {
+	entry := logEntry{done: make(chan error, 1)}
+	if err := c.send(ctx, entry); err != nil {
+		return err
+	}
+	select {
+	case err := <-entry.done:
 		return err
+	case <-c.stopped:
+		return nil // 写入 Go 程退出前会同步所有文件
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 阻塞发送到信道, Consumer 已关闭时返回 nil
+func (c *LogConsumer) send(ctx context.Context, entry logEntry) error {
+	c.chMutex.RLock()
+	defer c.chMutex.RUnlock()
+	if c.closed {
+		return nil
+	}
+	select {
+	case c.ch <- entry:
+		return nil
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return c.secondFile.Sync()
 }
 
 func (c *LogConsumer) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// 关闭信道, 之后的 Add 返回 ErrConsumerClosed
+func (c *LogConsumer) closeChannel() bool {
+	c.chMutex.Lock()
+	defer c.chMutex.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
 	close(c.ch)
-	c.wg.Wait()
-	return nil
+	return true
 }
 
-func (c *LogConsumer) constructFileName(i int) string {
-	fileNamePrefix := ""
-	if len(c.fileNamePrefix) != 0 {
-		fileNamePrefix = c.fileNamePrefix + "."
+// CloseCtx 关闭信道并等待写入 Go 程退出, ctx 取消或超时时停止等待
+func (c *LogConsumer) CloseCtx(ctx context.Context) error {
+	if !c.closeChannel() {
+		return nil
 	}
-	if c.fileSize > 0 {
-		return fmt.Sprintf("%s/%slog.%s_%d", c.directory, fileNamePrefix, time.Now().Format(c.dateFormat), i)
-	} else {
-		return fmt.Sprintf("%s/%slog.%s", c.directory, fileNamePrefix, time.Now().Format(c.dateFormat))
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // 开启一个 Go 程从信道中读入数据，并写入文件
 func (c *LogConsumer) init() error {
-	//判断目录是否存在
-	_, err := os.Stat(c.directory)
-	if err != nil && os.IsNotExist(err) {
-		e := os.MkdirAll(c.directory, os.ModePerm)
-		if e != nil {
-			return e
-		}
+	for _, config := range c.sinkConfigs {
+		c.sinks = append(c.sinks, c.newSink(config))
 	}
-	if c.secondDir != "" { //第二个目录
-		_, err := os.Stat(c.secondDir)
-		if err != nil && os.IsNotExist(err) {
-			e := os.MkdirAll(c.secondDir, os.ModePerm)
-			if e != nil {
-				return e
-			}
+	for _, sink := range c.sinks {
+		//判断目录是否存在
+		if err := os.MkdirAll(sink.dir, os.ModePerm); err != nil {
+			return err
 		}
-	}
-	//如果要保存
-	fd, err := os.OpenFile(c.constructFileName(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Printf("open failed: %s\n", err)
-		return err
-	}
-	c.currentFile = fd
-
-	if c.secondDir != "" { //如果要保存第二份日志
-		fName := strings.Replace(c.constructFileName(0), c.directory, c.secondDir, 1) //将目录替换成第二份日志的地址
-		fd1, err := os.OpenFile(fName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-		if err != nil {
-			fmt.Printf("open failed: %s\n", err)
+		if err := c.rotate(sink, 0); err != nil {
 			return err
 		}
-		c.secondFile = fd1
+		sink.health = LogHealth{Directory: sink.dir, Healthy: true}
 	}
 
 	c.wg.Add(1)
+	go c.run()
 
-	go func() {
-		defer func() {
-			if c.currentFile != nil {
-				c.currentFile.Sync()
-				c.currentFile.Close()
-			}
-			if c.secondFile != nil {
-				c.secondFile.Sync()
-				c.secondFile.Close()
-			}
-			c.wg.Done()
-		}()
-		i := 0
-		for {
-			select {
-			case rec, ok := <-c.ch:
-				if !ok {
-					return
-				}
-
-				// 判断是否要切分日志: 根据切分模式和当前日志文件大小来判断
-				var newName string
-				fname := c.constructFileName(i)
-				if c.currentFile.Name() != fname {
-					newName = fname
-				} else if c.fileSize > 0 {
-					stat, _ := c.currentFile.Stat()
-					if stat.Size() > c.fileSize {
-						i++
-						newName = c.constructFileName(i)
-					}
-				}
-
-				if newName != "" {
-					c.currentFile.Close()
-					c.currentFile, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-					if err != nil {
-						fmt.Printf("open failed: %s\n", err)
-						return
-					}
-				}
-
-				_, err = fmt.Fprintln(c.currentFile, rec)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "LoggerWriter(%q): %s\n", c.currentFile.Name(), err)
-					return
-				}
-
-				if c.secondDir != "" { //第二份日志
-					var newName string
-					fname := strings.Replace(c.constructFileName(i), c.directory, c.secondDir, 1) //将目录替换成第二份日志的地址
-					if c.secondFile.Name() != fname {
-						newName = fname
-					} else if c.fileSize > 0 {
-						stat, _ := c.secondFile.Stat()
-						if stat.Size() > c.fileSize {
-							i++
-							newName = strings.Replace(c.constructFileName(i), c.directory, c.secondDir, 1) //将目录替换成第二份日志的地址
-						}
-					}
-
-					if newName != "" {
-						c.secondFile.Close()
-						c.secondFile, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-						if err != nil {
-							fmt.Printf("open failed: %s\n", err)
-							return
-						}
-					}
-
-					_, err = fmt.Fprintln(c.secondFile, rec)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "LoggerWriter(%q): %s\n", c.secondFile.Name(), err)
-						return
-					}
-				}
-			}
+	for _, sink := range c.sinks {
+		if sink.retention.enabled() {
+			c.rotated = make(chan struct{}, 1)
+			c.wg.Add(1)
+			go c.janitor()
+			break
 		}
-	}()
-
+	}
 	return nil
 }
+
+// 回调 OnError, 未设置时打印到标准错误输出. lines 为写入失败的数据
+func (c *LogConsumer) onError(err error, lines ...[]byte) {
+	reportLines(c.errorCallback, err, lines)
+}
+
+func (c *LogConsumer) onDelivered(dest string, n int) {
+	if c.deliveredCallback != nil {
+		c.deliveredCallback(dest, n)
+	}
+}
@@ -0,0 +1,226 @@
+package herodata
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录 OnError 回调的错误和数据
+type logErrors struct {
+	mutex sync.Mutex
+	errs  []error
+	data  []Data
+}
+
+func (e *logErrors) onError(err error, data []Data) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.errs = append(e.errs, err)
+	e.data = append(e.data, data...)
+}
+
+// 返回第一个匹配 target 的错误及其回调的数据
+func (e *logErrors) find(target error) (bool, []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var found bool
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			found = true
+		}
+	}
+	var events []string
+	for _, d := range e.data {
+		events = append(events, d.EventName)
+	}
+	return found, events
+}
+
+func newTestLogConsumer(t *testing.T, config LogConfig) *LogConsumer {
+	t.Helper()
+	consumer, err := NewLogConsumerWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { consumer.Close() })
+	return consumer.(*LogConsumer)
+}
+
+// 用普通文件占用日志目录的位置, 目录无法重新创建, 写入时进入降级状态
+func blockLogDirectory(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 读取目录中所有日志文件的内容
+func readLogDirectory(t *testing.T, dir string) string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "log.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content strings.Builder
+	for _, name := range files {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.Write(b)
+	}
+	return content.String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 日志目录被删除后重新创建目录和文件继续写入
+func TestLogConsumerDirectoryRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	consumer := newTestLogConsumer(t, LogConfig{Directory: dir})
+	consumer.Add(Data{EventName: "a"})
+	if err := consumer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	consumer.Add(Data{EventName: "b"})
+	if err := consumer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	content := readLogDirectory(t, dir)
+	if !strings.Contains(content, `"b"`) || strings.Contains(content, `"a"`) {
+		t.Fatalf("got %q", content)
+	}
+}
+
+// 目录无法写入时进入降级状态, 数据暂存在内存中, 目录恢复后按退避时间重试写入
+func TestLogConsumerDegradedRecovery(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	errs := &logErrors{}
+	consumer := newTestLogConsumer(t, LogConfig{
+		Directory:   dir,
+		RetryPolicy: &RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		OnError:     errs.onError,
+	})
+	consumer.Add(Data{EventName: "a"})
+	if err := consumer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	blockLogDirectory(t, dir)
+	consumer.Add(Data{EventName: "b"})
+	if err := consumer.Flush(); !errors.Is(err, ErrLogUnavailable) {
+		t.Fatalf("got %v, want ErrLogUnavailable", err)
+	}
+	if health := consumer.Health()[0]; health.Healthy || health.Buffered != 1 || health.LastError == nil {
+		t.Fatalf("got %+v", health)
+	}
+	if found, _ := errs.find(ErrLogUnavailable); !found {
+		t.Fatal("OnError not called with ErrLogUnavailable")
+	}
+
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "recovery", func() bool { return consumer.Health()[0].Healthy })
+	if err := consumer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if content := readLogDirectory(t, dir); !strings.Contains(content, `"b"`) {
+		t.Fatalf("got %q", content)
+	}
+}
+
+// Flush 返回时之前写入的数据都已写入文件, 不等待 BufferFlushInterval
+func TestLogConsumerFlushWritesFile(t *testing.T) {
+	dir := t.TempDir()
+	consumer := newTestLogConsumer(t, LogConfig{
+		Directory:           dir,
+		SyncPolicy:          SyncNever,
+		BufferFlushInterval: time.Hour,
+	})
+	const events = 100
+	for i := 0; i < events; i++ {
+		if err := consumer.Add(Data{EventName: "e"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := consumer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(readLogDirectory(t, dir), "\n"); n != events {
+		t.Fatalf("got %d lines, want %d", n, events)
+	}
+}
+
+// 降级期间暂存的数据超过 MaxBuffered 时丢弃最早的数据并回调 OnError
+func TestLogConsumerMaxBuffered(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	errs := &logErrors{}
+	consumer := newTestLogConsumer(t, LogConfig{
+		Directory:   dir,
+		MaxBuffered: 2,
+		RetryPolicy: &RetryPolicy{BaseBackoff: time.Hour},
+		OnError:     errs.onError,
+	})
+	blockLogDirectory(t, dir)
+	for _, name := range []string{"a", "b", "c"} {
+		consumer.Add(Data{EventName: name})
+		consumer.Flush()
+	}
+	found, events := errs.find(ErrCacheFull)
+	if !found || strings.Join(events, ",") != "a" {
+		t.Fatalf("got %v %v, want ErrCacheFull with [a]", found, events)
+	}
+	if consumer.Dropped() != 1 || consumer.Health()[0].Buffered != 2 {
+		t.Fatalf("dropped %d, health %+v", consumer.Dropped(), consumer.Health()[0])
+	}
+}
+
+// 降级状态下关闭时不会阻塞, 仍未写入的数据通过 OnError 回调
+func TestLogConsumerCloseDegraded(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	errs := &logErrors{}
+	consumer := newTestLogConsumer(t, LogConfig{
+		Directory:   dir,
+		RetryPolicy: &RetryPolicy{BaseBackoff: time.Hour},
+		OnError:     errs.onError,
+	})
+	blockLogDirectory(t, dir)
+	consumer.Add(Data{EventName: "a"})
+	consumer.Add(Data{EventName: "b"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := consumer.CloseCtx(ctx); err != nil {
+		t.Fatal(err)
+	}
+	found, events := errs.find(ErrConsumerClosed)
+	if !found || strings.Join(events, ",") != "a,b" {
+		t.Fatalf("got %v %v, want ErrConsumerClosed with [a b]", found, events)
+	}
+	if err := consumer.Add(Data{EventName: "c"}); !errors.Is(err, ErrConsumerClosed) {
+		t.Fatalf("got %v, want ErrConsumerClosed", err)
+	}
+}
@@ -0,0 +1,167 @@
+// MultiConsumer 将数据同时交给多个 Consumer, 如同时写入本地文件和发送到接收端
+package herodata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MultiErrorPolicy 子 Consumer 出错时的处理方式
+type MultiErrorPolicy int32
+
+const (
+	MultiBestEffort MultiErrorPolicy = 0 // 所有子 Consumer 都执行, 返回合并后的错误, 可用 errors.Is 判断其中的每个错误
+	MultiFailFast   MultiErrorPolicy = 1 // 按顺序执行, 遇到第一个错误立即返回, 之后的子 Consumer 不再执行. Close 总是关闭所有子 Consumer
+)
+
+// MultiTarget 一个子 Consumer 及其接收的数据
+type MultiTarget struct {
+	Name     string   // 名称, 用于错误信息, 默认为 consumer 序号
+	Consumer Consumer // 子 Consumer
+
+	Types  []string          // 只接收这些类型(#type)的数据, 如 Track、UserSet, 为空时接收所有类型
+	Filter func(d Data) bool // 返回 false 时不接收该数据, 与 Types 同时设置时需同时满足
+}
+
+type MultiConfig struct {
+	Targets     []MultiTarget
+	ErrorPolicy MultiErrorPolicy // 默认 MultiBestEffort
+}
+
+type MultiConsumer struct {
+	targets     []MultiTarget
+	errorPolicy MultiErrorPolicy
+
+	mutex  sync.RWMutex // 保护 closed
+	closed bool
+}
+
+// 创建 MultiConsumer, 每条数据交给所有 consumers, 出错时返回合并后的错误
+func NewMultiConsumer(consumers ...Consumer) (Consumer, error) {
+	config := MultiConfig{}
+	for _, c := range consumers {
+		config.Targets = append(config.Targets, MultiTarget{Consumer: c})
+	}
+	return NewMultiConsumerWithConfig(config)
+}
+
+func NewMultiConsumerWithConfig(config MultiConfig) (Consumer, error) {
+	if len(config.Targets) == 0 {
+		return nil, errors.New("consumers can not be empty.")
+	}
+	switch config.ErrorPolicy {
+	case MultiBestEffort, MultiFailFast:
+	default:
+		return nil, errors.New("Unknown multi error policy.")
+	}
+	targets := make([]MultiTarget, len(config.Targets))
+	for i, t := range config.Targets {
+		if t.Consumer == nil {
+			return nil, fmt.Errorf("consumer %d can not be nil.", i)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("consumer %d", i)
+		}
+		targets[i] = t
+	}
+	return &MultiConsumer{targets: targets, errorPolicy: config.ErrorPolicy}, nil
+}
+
+// 判断子 Consumer 是否接收该数据
+func (t MultiTarget) accepts(d Data) bool {
+	if len(t.Types) > 0 && !containsString(t.Types, d.Type) {
+		return false
+	}
+	return t.Filter == nil || t.Filter(d)
+}
+
+func (c *MultiConsumer) Add(d Data) error {
+	return c.AddCtx(context.Background(), d)
+}
+
+// AddCtx 将数据交给接收该数据的子 Consumer
+func (c *MultiConsumer) AddCtx(ctx context.Context, d Data) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return ErrConsumerClosed
+	}
+	return c.each(func(t MultiTarget) error {
+		if !t.accepts(d) {
+			return nil
+		}
+		if cc, ok := t.Consumer.(ContextConsumer); ok {
+			return cc.AddCtx(ctx, d)
+		}
+		return t.Consumer.Add(d)
+	}, c.errorPolicy)
+}
+
+func (c *MultiConsumer) Flush() error {
+	return c.FlushCtx(context.Background())
+}
+
+// FlushCtx 依次 Flush 所有子 Consumer
+func (c *MultiConsumer) FlushCtx(ctx context.Context) error {
+	return c.each(func(t MultiTarget) error {
+		if cc, ok := t.Consumer.(ContextConsumer); ok {
+			return cc.FlushCtx(ctx)
+		}
+		return t.Consumer.Flush()
+	}, c.errorPolicy)
+}
+
+func (c *MultiConsumer) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// CloseCtx 依次关闭所有子 Consumer, 即使某个子 Consumer 关闭失败. MultiFailFast 时只返回第一个错误
+func (c *MultiConsumer) CloseCtx(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mutex.Unlock()
+
+	err := c.each(func(t MultiTarget) error {
+		if cc, ok := t.Consumer.(ContextConsumer); ok {
+			return cc.CloseCtx(ctx)
+		}
+		return t.Consumer.Close()
+	}, MultiBestEffort)
+	if joined, ok := err.(interface{ Unwrap() []error }); ok && c.errorPolicy == MultiFailFast {
+		return joined.Unwrap()[0]
+	}
+	return err
+}
+
+// 对每个子 Consumer 执行 fn, 错误中带上子 Consumer 的名称
+func (c *MultiConsumer) each(fn func(t MultiTarget) error, policy MultiErrorPolicy) error {
+	var errs []error
+	for _, t := range c.targets {
+		if err := fn(t); err != nil {
+			// ReceiverError 中已带有接收端名称, 无需重复
+			if re := (*ReceiverError)(nil); !errors.As(err, &re) || re.Destination != t.Name {
+				err = fmt.Errorf("%s: %w", t.Name, err)
+			}
+			if policy == MultiFailFast {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
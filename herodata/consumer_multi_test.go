@@ -0,0 +1,154 @@
+package herodata
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 记录收到的数据, 可指定 Add 和 Close 返回的错误
+type multiTestConsumer struct {
+	mutex    sync.Mutex
+	events   []string
+	addErr   error
+	closeErr error
+	closed   bool
+}
+
+func (c *multiTestConsumer) Add(d Data) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = append(c.events, d.EventName)
+	return c.addErr
+}
+
+func (c *multiTestConsumer) Flush() error {
+	return nil
+}
+
+func (c *multiTestConsumer) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return c.closeErr
+}
+
+func (c *multiTestConsumer) received() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return strings.Join(c.events, ",")
+}
+
+func newTestMultiConsumer(t *testing.T, policy MultiErrorPolicy, targets ...MultiTarget) *MultiConsumer {
+	t.Helper()
+	consumer, err := NewMultiConsumerWithConfig(MultiConfig{Targets: targets, ErrorPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consumer.(*MultiConsumer)
+}
+
+// MultiBestEffort 时所有子 Consumer 都执行, MultiFailFast 时遇到第一个错误立即返回
+func TestMultiConsumerErrorPolicy(t *testing.T) {
+	errA, errC := errors.New("a failed"), errors.New("c failed")
+	tests := []struct {
+		policy   MultiErrorPolicy
+		received string // b 和 c 收到的数据
+		errC     bool   // 返回的错误中是否包含 c 的错误
+	}{
+		{MultiBestEffort, "e", true},
+		{MultiFailFast, "", false},
+	}
+	for _, tt := range tests {
+		a, b, c := &multiTestConsumer{addErr: errA}, &multiTestConsumer{}, &multiTestConsumer{addErr: errC}
+		consumer := newTestMultiConsumer(t, tt.policy, MultiTarget{Consumer: a}, MultiTarget{Consumer: b}, MultiTarget{Consumer: c})
+		err := consumer.Add(Data{EventName: "e"})
+		if !errors.Is(err, errA) || errors.Is(err, errC) != tt.errC {
+			t.Fatalf("policy %d: got %v", tt.policy, err)
+		}
+		if b.received() != tt.received || c.received() != tt.received {
+			t.Fatalf("policy %d: b received %q, c received %q, want %q", tt.policy, b.received(), c.received(), tt.received)
+		}
+	}
+}
+
+// 子 Consumer 只接收 Types 中的类型且 Filter 返回 true 的数据
+func TestMultiConsumerTypesAndFilter(t *testing.T) {
+	all, users, filtered := &multiTestConsumer{}, &multiTestConsumer{}, &multiTestConsumer{}
+	consumer := newTestMultiConsumer(t, MultiBestEffort,
+		MultiTarget{Consumer: all},
+		MultiTarget{Consumer: users, Types: []string{UserSet}},
+		MultiTarget{Consumer: filtered, Types: []string{Track}, Filter: func(d Data) bool { return d.EventName != "skip" }},
+	)
+	for _, d := range []Data{
+		{Type: Track, EventName: "login"},
+		{Type: Track, EventName: "skip"},
+		{Type: UserSet, EventName: "profile"},
+	} {
+		if err := consumer.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := all.received(); got != "login,skip,profile" {
+		t.Fatalf("all received %q", got)
+	}
+	if got := users.received(); got != "profile" {
+		t.Fatalf("users received %q", got)
+	}
+	if got := filtered.received(); got != "login" {
+		t.Fatalf("filtered received %q", got)
+	}
+}
+
+// 错误中带上子 Consumer 的名称, 接收端名称与之相同的 ReceiverError 不再重复
+func TestMultiConsumerErrorNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		prefix bool
+	}{
+		{"log", errors.New("disk full"), true},
+		{"hero", &ReceiverError{Destination: "hero", Err: ErrUnexpectedStatus}, false},
+		{"backup", &ReceiverError{Destination: "hero", Err: ErrUnexpectedStatus}, true},
+		{"", errors.New("disk full"), true},
+	}
+	for _, tt := range tests {
+		consumer := newTestMultiConsumer(t, MultiBestEffort, MultiTarget{Name: tt.name, Consumer: &multiTestConsumer{addErr: tt.err}})
+		err := consumer.Add(Data{EventName: "e"})
+		name := tt.name
+		if name == "" {
+			name = "consumer 0"
+		}
+		want := tt.err.Error()
+		if tt.prefix {
+			want = name + ": " + want
+		}
+		if !errors.Is(err, tt.err) || err.Error() != want {
+			t.Fatalf("target %q: got %q, want %q", name, err, want)
+		}
+	}
+}
+
+// CloseCtx 总是关闭所有子 Consumer, MultiFailFast 时只返回第一个错误
+func TestMultiConsumerClose(t *testing.T) {
+	errA, errC := errors.New("a close failed"), errors.New("c close failed")
+	for _, policy := range []MultiErrorPolicy{MultiBestEffort, MultiFailFast} {
+		a, b, c := &multiTestConsumer{closeErr: errA}, &multiTestConsumer{}, &multiTestConsumer{closeErr: errC}
+		consumer := newTestMultiConsumer(t, policy, MultiTarget{Consumer: a}, MultiTarget{Consumer: b}, MultiTarget{Consumer: c})
+		err := consumer.CloseCtx(context.Background())
+		if !a.closed || !b.closed || !c.closed {
+			t.Fatalf("policy %d: closed %v %v %v", policy, a.closed, b.closed, c.closed)
+		}
+		if !errors.Is(err, errA) || errors.Is(err, errC) != (policy == MultiBestEffort) {
+			t.Fatalf("policy %d: got %v", policy, err)
+		}
+		if err := consumer.Add(Data{EventName: "e"}); !errors.Is(err, ErrConsumerClosed) {
+			t.Fatalf("policy %d: got %v after close, want ErrConsumerClosed", policy, err)
+		}
+		if err := consumer.Close(); err != nil {
+			t.Fatalf("policy %d: second close returned %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package herodata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 接收端协议
+const (
+	ProtocolHero   = "hero"   // 默认接收端协议, 请求头为 HERO-DATA-Integration-*
+	ProtocolShuShu = "shushu" // 数数科技接收端协议, 请求头为 TA-Integration-*
+)
+
+// DestinationConfig 接收端配置
+type DestinationConfig struct {
+	Name      string // 接收端名称, 用于状态和错误信息, 为空时使用 ServerUrl
+	ServerUrl string // 接收端地址, 按原样使用
+	AppId     string // 项目 APP ID
+	Protocol  string // 接收端协议, 默认 ProtocolHero
+}
+
+// DestinationStatus 接收端的发送状态
+type DestinationStatus struct {
+	Name      string
+	ServerUrl string
+	Pending   int       // 待发送的批次数
+	Sent      int64     // 已被接收端确认的批次数
+	Delivered int64     // 已被接收端确认且 code 为 0 的数据条数
+	Failed    int64     // 失败的发送次数
+	Dropped   int64     // 缓存溢出被丢弃的批次数, 被丢弃的数据会通过 OnError 回调, 错误为 ErrCacheFull
+	LastError error     // 最近一次错误, 发送成功后清空
+	LastSent  time.Time // 最近一次被确认的时间
+}
+
+// 接收端, 拥有独立的缓存区和发送状态
+type destination struct {
+	name      string
+	serverUrl string
+	appId     string
+	protocol  string
+
+	mutex       *sync.Mutex // 保护 cacheBuffer、status 和退避状态, 发送过程中不持有
+	cacheBuffer []*batch    // 待发送的批次
+	spill       *spillQueue // 磁盘队列, 未开启时为 nil
+	status      DestinationStatus
+	attempt     int       // 连续失败的发送次数, 收到接收端的响应后清零
+	retryAt     time.Time // 退避结束的时间, 在此之前不发送
+}
+
+// 根据配置创建接收端列表, 顺序为 ServerUrl、ShuShuServerUrl、Destinations
+func newDestinations(config BatchConfig) ([]*destination, error) {
+	var result []*destination
+	if config.ServerUrl != "" {
+		result = append(result, newDestination(DestinationConfig{
+			Name:      "hero",
+			ServerUrl: config.ServerUrl,
+			AppId:     config.AppId,
+			Protocol:  ProtocolHero,
+		}))
+	}
+	if config.ShuShuServerUrl != "" {
+		//数数的为可选
+		u, err := url.Parse(config.ShuShuServerUrl)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = "/sync_server"
+		result = append(result, newDestination(DestinationConfig{
+			Name:      "shushu",
+			ServerUrl: u.String(),
+			AppId:     config.ShuShuAppId,
+			Protocol:  ProtocolShuShu,
+		}))
+	}
+	for _, dc := range config.Destinations {
+		if _, err := url.Parse(dc.ServerUrl); err != nil {
+			return nil, err
+		}
+		result = append(result, newDestination(dc))
+	}
+	// 名称用于区分状态、错误和磁盘队列目录, 不能重复
+	names := make(map[string]bool, len(result))
+	for _, dest := range result {
+		if names[dest.name] {
+			return nil, fmt.Errorf("Destination name %q is duplicated.", dest.name)
+		}
+		names[dest.name] = true
+	}
+
+	if config.SpillDirectory != "" {
+		for _, dest := range result {
+			spill, replay, err := openSpillQueue(config.SpillDirectory, dest.name, config.SpillMaxBytes)
+			if err != nil {
+				return nil, err
+			}
+			dest.spill = spill
+			dest.cacheBuffer = replay
+		}
+	}
+	return result, nil
+}
+
+func newDestination(config DestinationConfig) *destination {
+	name := config.Name
+	if name == "" {
+		name = config.ServerUrl
+	}
+	protocol := config.Protocol
+	if protocol == "" {
+		protocol = ProtocolHero
+	}
+	return &destination{
+		name:      name,
+		serverUrl: config.ServerUrl,
+		appId:     config.AppId,
+		protocol:  protocol,
+		mutex:     new(sync.Mutex),
+		status:    DestinationStatus{Name: name, ServerUrl: config.ServerUrl},
+	}
+}
+
+// 将一批数据加入缓存区, 返回因缓存溢出被丢弃的数据.
+// 开启磁盘队列时只标记为待写入, 由 persist 写入磁盘后再限制缓存区大小
+func (d *destination) push(data []Data, capacity int) [][]Data {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.cacheBuffer = append(d.cacheBuffer, &batch{data: data, count: len(data), unsaved: d.spill != nil})
+	if d.spill != nil {
+		return nil
+	}
+	return d.trim(capacity)
+}
+
+// 按顺序将待写入的批次写入磁盘队列, 写入失败则只保存在内存中. 返回因缓存溢出被丢弃的数据.
+// 写入和同步磁盘时不持有 mutex, 不会阻塞同时进行的 Add 和发送
+func (d *destination) persist(capacity int) [][]Data {
+	if d.spill == nil {
+		return nil
+	}
+	type pending struct {
+		b    *batch
+		name string
+	}
+	d.mutex.Lock()
+	var writes []pending
+	for _, b := range d.cacheBuffer {
+		if b.unsaved {
+			b.unsaved = false
+			writes = append(writes, pending{b, d.spill.reserve(b)})
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, w := range writes {
+		size, err := writeSegment(w.name, w.b.data)
+		d.mutex.Lock()
+		switch {
+		case err != nil:
+			d.status.LastError = err
+		case !d.cached(w.b):
+			// 写入期间已被发送或因缓存溢出丢弃
+			os.Remove(w.name)
+		default:
+			d.spill.add(w.b, w.name, size)
+		}
+		d.mutex.Unlock()
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.trim(capacity)
+}
+
+// 批次是否仍在缓存区中, 调用方需持有 mutex
+func (d *destination) cached(b *batch) bool {
+	for _, c := range d.cacheBuffer {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
+
+// 限制缓存区大小, 调用方需持有 mutex. 正在发送的批次不受影响.
+// 内存中最多保留 capacity 批数据, 已写入磁盘的批次释放内存, 否则抛弃最早的一块数据.不然网络一直错误将会造成阻塞.
+// 磁盘队列超过上限时抛弃最早的批次. 返回被丢弃的数据
+func (d *destination) trim(capacity int) [][]Data {
+	var dropped [][]Data
+	if d.spill != nil {
+		for i := 0; d.spill.full() && i < len(d.cacheBuffer)-1; i++ {
+			if b := d.cacheBuffer[i]; !b.inflight {
+				data := b.data
+				if data == nil {
+					data, _ = d.spill.read(b)
+				}
+				dropped = append(dropped, data)
+				d.spill.remove(b)
+				d.remove(i)
+				d.status.Dropped++
+				metrics().Counter(MetricCacheDropped, 1, d.name)
+				i--
+			}
+		}
+	}
+
+	resident := 0
+	for _, b := range d.cacheBuffer {
+		if b.data != nil {
+			resident++
+		}
+	}
+	for i := 0; resident > capacity && i < len(d.cacheBuffer); i++ {
+		b := d.cacheBuffer[i]
+		if b.data == nil || b.inflight {
+			continue
+		}
+		resident--
+		if b.segment != "" {
+			b.data = nil
+			continue
+		}
+		dropped = append(dropped, b.data)
+		d.remove(i)
+		d.status.Dropped++
+		metrics().Counter(MetricCacheDropped, 1, d.name)
+		i--
+	}
+	return dropped
+}
+
+// 从缓存区移除第 i 批数据, 调用方需持有 mutex
+func (d *destination) remove(i int) {
+	d.cacheBuffer = append(d.cacheBuffer[:i], d.cacheBuffer[i+1:]...)
+}
+
+// 取出缓存区中第一批未在发送中的数据并标记为发送中, 没有可发送的数据时返回 nil.
+// 数据只在磁盘中时从磁盘读取
+func (d *destination) next() (*batch, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, b := range d.cacheBuffer {
+		if b.inflight {
+			continue
+		}
+		if b.data == nil && b.segment != "" {
+			data, err := d.spill.read(b)
+			if err != nil {
+				// 无法读取的文件不再重试
+				d.spill.remove(b)
+				d.remove(i)
+				d.status.Dropped++
+				return nil, err
+			}
+			b.data = data
+		}
+		b.inflight = true
+		return b, nil
+	}
+	return nil, nil
+}
+
+// 接收端已响应, 从缓存区移除该批数据并删除磁盘文件, 记录确认
+func (d *destination) done(b *batch, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := range d.cacheBuffer {
+		if d.cacheBuffer[i] == b {
+			d.remove(i)
+			break
+		}
+	}
+	if d.spill != nil {
+		d.spill.remove(b)
+	}
+	d.status.Sent++
+	if err == nil {
+		d.status.Delivered += int64(b.count)
+	}
+	d.status.LastSent = time.Now()
+	d.status.LastError = err
+}
+
+// 发送失败, 数据留在缓存区等待下一次上报
+func (d *destination) release(b *batch) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	b.inflight = false
+}
+
+// 记录发送失败
+func (d *destination) fail(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.status.Failed++
+	d.status.LastError = err
+}
+
+// 一次发送的结果
+type sendResult int
+
+const (
+	sendDelivered sendResult = iota // 已被接收端确认
+	sendRejected                    // 被接收端拒绝, 数据不再重试
+	sendRetry                       // 发送失败, 退避结束后可以重试
+	sendFailed                      // 发送失败, 已达到最大尝试次数
+)
+
+// 发送一批 JSON 数据并按重试策略判断结果, 只尝试一次. 可重试的错误只记录退避时间, 不在当前 Go 程中等待.
+// 发送成功时返回的错误为 nil
+func (d *destination) deliver(ctx context.Context, jdata string, size int, timeout time.Duration, compress bool, policy RetryPolicy) (sendResult, *ReceiverError) {
+	statusCode, code, retryAfter, sendErr := d.send(ctx, jdata, size, timeout, compress)
+	re := &ReceiverError{
+		Destination: d.name,
+		ServerUrl:   d.serverUrl,
+		StatusCode:  statusCode,
+		Code:        code,
+		BatchSize:   size,
+	}
+	switch {
+	case statusCode == 200 && (code == 0 || !policy.retryableCode(code)):
+		d.resetBackoff()
+		re.Err = codeError(code)
+		if re.Err == nil {
+			metrics().Counter(MetricBatchesSent, 1, d.name)
+			return sendDelivered, nil
+		}
+		re.Dropped = true
+		metrics().Counter(MetricBatchesFailed, 1, d.name)
+		return sendRejected, re
+	case statusCode == 200:
+		// 可重试的 code 不会移除数据
+		re.Err = codeError(code)
+	case sendErr != nil:
+		// 网络错误总是可以重试
+		re.Err = &transportError{err: sendErr}
+	case policy.retryableStatus(statusCode):
+		re.Err = ErrUnexpectedStatus
+	default:
+		// 不可重试的状态码与被拒绝的 code 相同, 丢弃数据, 否则每次上报都会立即重发
+		d.resetBackoff()
+		re.Err = ErrUnexpectedStatus
+		re.Dropped = true
+		metrics().Counter(MetricBatchesFailed, 1, d.name)
+		return sendRejected, re
+	}
+	d.fail(re)
+
+	if d.backoff(policy, retryAfter) {
+		metrics().Counter(MetricBatchesFailed, 1, d.name)
+		return sendFailed, re
+	}
+	metrics().Counter(MetricRetries, 1, d.name)
+	return sendRetry, re
+}
+
+// 可重试的发送失败后进入退避, 返回是否已达到最大尝试次数. 达到后重新计数, 但仍需等待退避结束
+func (d *destination) backoff(policy RetryPolicy, retryAfter time.Duration) (exhausted bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.attempt++
+	d.retryAt = time.Now().Add(policy.backoff(d.attempt, retryAfter))
+	if d.attempt >= policy.MaxAttempts {
+		d.attempt = 0
+		return true
+	}
+	return false
+}
+
+// 收到接收端的响应后结束退避
+func (d *destination) resetBackoff() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.attempt = 0
+	d.retryAt = time.Time{}
+}
+
+// 距退避结束的时间, 不在退避中时返回 0
+func (d *destination) retryWait() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.retryAt.IsZero() {
+		return 0
+	}
+	return time.Until(d.retryAt)
+}
+
+// 缓存区中的批次数. available 为 true 时不包含正在发送中的批次
+func (d *destination) pending(available bool) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !available {
+		return len(d.cacheBuffer)
+	}
+	n := 0
+	for _, b := range d.cacheBuffer {
+		if !b.inflight {
+			n++
+		}
+	}
+	return n
+}
+
+// 退避期间缓存区中仍有数据时返回最近一次发送失败的错误
+func (d *destination) pendingError() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.cacheBuffer) == 0 {
+		return nil
+	}
+	return d.status.LastError
+}
+
+// 关闭时放弃缓存区中的数据. 返回只在内存中的数据, 以及已写入磁盘队列、下次启动时会重新发送的条数
+func (d *destination) abandon() (memory [][]Data, spilled int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, b := range d.cacheBuffer {
+		if b.segment != "" {
+			spilled += int64(b.count)
+		} else {
+			memory = append(memory, b.data)
+		}
+	}
+	d.cacheBuffer = nil
+	return memory, spilled
+}
+
+func (d *destination) snapshot() DestinationStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := d.status
+	s.Pending = len(d.cacheBuffer)
+	return s
+}
+
+// 发送数据到接收端, 返回 HTTP 状态码、接收端返回的 code 和 Retry-After 等待时间
+func (d *destination) send(ctx context.Context, data string, size int, timeout time.Duration, compress bool) (statusCode int, code int, retryAfter time.Duration, err error) {
+	var encodedData string
+	var compressType = "gzip"
+	if compress {
+		encodedData, err = encodeData(data)
+	} else {
+		encodedData = data
+		compressType = "none"
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	postData := bytes.NewBufferString(encodedData)
+
+	var resp *http.Response
+	req, err := http.NewRequestWithContext(ctx, "POST", d.serverUrl, postData)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	req.Header["appid"] = []string{d.appId}
+	req.Header.Set("version", SdkVersion)
+	req.Header.Set("compress", compressType)
+	if d.protocol == ProtocolShuShu {
+		req.Header.Set("user-agent", "ta-go-sdk")
+		req.Header["TA-Integration-Type"] = []string{LibName}
+		req.Header["TA-Integration-Version"] = []string{SdkVersion}
+		req.Header["TA-Integration-Count"] = []string{strconv.Itoa(size)}
+	} else {
+		req.Header.Set("user-agent", "hero-go-sdk")
+		req.Header["HERO-DATA-Integration-Type"] = []string{LibName}
+		req.Header["HERO-DATA-Integration-Version"] = []string{SdkVersion}
+		req.Header["HERO-DATA-Integration-Count"] = []string{strconv.Itoa(size)}
+	}
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err = client.Do(req)
+	metrics().Histogram(MetricSendLatency, time.Since(start).Seconds(), d.name)
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		var result struct {
+			Code int
+		}
+
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			return resp.StatusCode, 1, 0, err
+		}
+
+		return resp.StatusCode, result.Code, 0, nil
+	} else {
+		return resp.StatusCode, 0, parseRetryAfter(resp.Header.Get("Retry-After")), nil
+	}
+}
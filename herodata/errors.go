@@ -0,0 +1,91 @@
+package herodata
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 可用 errors.Is 判断的错误
+var (
+	ErrInvalidData      = errors.New("herodata: invalid data format")       // 接收端返回 code 1 或 -1
+	ErrAppIdNotExist    = errors.New("herodata: APP ID doesn't exist")      // 接收端返回 code -2
+	ErrInvalidIp        = errors.New("herodata: invalid ip transmission")   // 接收端返回 code -3
+	ErrUnknownCode      = errors.New("herodata: unknown error")             // 接收端返回其他非 0 的 code
+	ErrUnexpectedStatus = errors.New("herodata: unexpected status code")    // 接收端返回非 200 的 HTTP 状态码
+	ErrTransport        = errors.New("herodata: transport error")           // 网络错误或超时, 未收到接收端的响应
+	ErrSpillCorrupted   = errors.New("herodata: corrupted spill segment")   // 磁盘队列中的文件无法读取
+	ErrQueueFull        = errors.New("herodata: queue is full")             // 队列已满, 数据被丢弃
+	ErrCacheFull        = errors.New("herodata: cache is full")             // 接收端缓存区已满, 最早的数据被丢弃
+	ErrConsumerClosed   = errors.New("herodata: consumer is closed")        // Consumer 已关闭
+	ErrLogUnavailable   = errors.New("herodata: log directory unavailable") // 日志文件无法写入, 数据暂存在内存中等待重试
+)
+
+// ReceiverError 发送到接收端失败时返回的错误
+type ReceiverError struct {
+	Destination string // 接收端名称
+	ServerUrl   string // 接收端地址
+	StatusCode  int    // HTTP 状态码, 0 表示未收到响应
+	Code        int    // 接收端返回的 code, 仅 StatusCode 为 200 时有效
+	BatchSize   int    // 该批数据的条数
+	Dropped     bool   // 数据已被接收端拒绝并丢弃, 不会再重试
+	Message     string // 接收端返回的错误信息
+	Err         error  // 错误原因, 为上面的哨兵错误之一, 或被 ErrTransport 包装的网络错误
+}
+
+func (e *ReceiverError) Error() string {
+	msg := fmt.Sprintf("%s: %s (status %d, code %d, batch size %d)", e.Destination, e.Err, e.StatusCode, e.Code, e.BatchSize)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *ReceiverError) Unwrap() error {
+	return e.Err
+}
+
+// 网络错误, 同时满足 errors.Is(err, ErrTransport) 和对原始错误的判断
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrTransport, e.err)
+}
+
+func (e *transportError) Unwrap() []error {
+	return []error{ErrTransport, e.err}
+}
+
+// 将接收端返回的 code 转换为错误
+func codeError(code int) error {
+	switch code {
+	case 0:
+		return nil
+	case 1, -1:
+		return ErrInvalidData
+	case -2:
+		return ErrAppIdNotExist
+	case -3:
+		return ErrInvalidIp
+	default:
+		return ErrUnknownCode
+	}
+}
+
+// 判断错误对应的数据是否都已被丢弃, 这类错误无需重试
+func isDropped(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if !isDropped(e) {
+				return false
+			}
+		}
+		return true
+	}
+	var re *ReceiverError
+	if errors.As(err, &re) {
+		return re.Dropped
+	}
+	return errors.Is(err, ErrSpillCorrupted)
+}
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package herodata
+
+import (
+	"errors"
+	"os"
+)
+
+const flockSupported = false
+
+var errFlockUnsupported = errors.New("file lock is not supported on this platform")
+
+func lockFile(f *os.File) error {
+	return errFlockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errFlockUnsupported
+}
@@ -1,8 +1,10 @@
 package herodata
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 )
 
 const (
@@ -41,17 +43,38 @@ type Consumer interface {
 	Close() error
 }
 
+// ContextConsumer 为支持 context 的 Consumer. ctx 被取消或超时时, 阻塞中的操作会立即返回 ctx.Err()
+type ContextConsumer interface {
+	Consumer
+	AddCtx(ctx context.Context, d Data) error
+	FlushCtx(ctx context.Context) error
+	CloseCtx(ctx context.Context) error
+}
+
 type TDAnalytics struct {
 	consumer        Consumer
 	superProperties map[string]interface{}
 	mutex           *sync.RWMutex
+	location        *time.Location
+}
+
+type TDAnalyticsConfig struct {
+	// 格式化 #time 和时间类型属性使用的时区, 同时决定事件的 #zone_offset.
+	// 为 nil 时 time.Time 按其自身的时区格式化, 当前时间使用本地时区
+	Location *time.Location
 }
 
 // 初始化 TDAnalytics
 func New(c Consumer) TDAnalytics {
+	return NewWithConfig(c, TDAnalyticsConfig{})
+}
+
+// 使用配置初始化 TDAnalytics
+func NewWithConfig(c Consumer, config TDAnalyticsConfig) TDAnalytics {
 	return TDAnalytics{consumer: c,
 		superProperties: make(map[string]interface{}),
-		mutex:           new(sync.RWMutex)}
+		mutex:           new(sync.RWMutex),
+		location:        config.Location}
 }
 
 // 返回公共事件属性
@@ -79,18 +102,23 @@ func (ta *TDAnalytics) ClearSuperProperties() {
 
 // 追踪一个事件
 func (ta *TDAnalytics) Track(accountId, distinctId, eventName string, properties map[string]interface{}) error {
-	return ta.track(accountId, distinctId, Track, eventName, "", properties)
+	return ta.track(context.Background(), accountId, distinctId, Track, eventName, "", properties)
+}
+
+// 追踪一个事件, ctx 取消或超时时停止等待
+func (ta *TDAnalytics) TrackCtx(ctx context.Context, accountId, distinctId, eventName string, properties map[string]interface{}) error {
+	return ta.track(ctx, accountId, distinctId, Track, eventName, "", properties)
 }
 
 func (ta *TDAnalytics) TrackUpdate(accountId, distinctId, eventName, eventId string, properties map[string]interface{}) error {
-	return ta.track(accountId, distinctId, TrackUpdate, eventName, eventId, properties)
+	return ta.track(context.Background(), accountId, distinctId, TrackUpdate, eventName, eventId, properties)
 }
 
 func (ta *TDAnalytics) TrackOverwrite(accountId, distinctId, eventName, eventId string, properties map[string]interface{}) error {
-	return ta.track(accountId, distinctId, TrackOverwrite, eventName, eventId, properties)
+	return ta.track(context.Background(), accountId, distinctId, TrackOverwrite, eventName, eventId, properties)
 }
 
-func (ta *TDAnalytics) track(accountId, distinctId, dataType, eventName, eventId string, properties map[string]interface{}) error {
+func (ta *TDAnalytics) track(ctx context.Context, accountId, distinctId, dataType, eventName, eventId string, properties map[string]interface{}) error {
 	if len(eventName) == 0 {
 		return errors.New("the event name must be provided")
 	}
@@ -105,12 +133,17 @@ func (ta *TDAnalytics) track(accountId, distinctId, dataType, eventName, eventId
 
 	mergeProperties(p, properties)
 
-	return ta.add(accountId, distinctId, dataType, eventName, eventId, p)
+	return ta.add(ctx, accountId, distinctId, dataType, eventName, eventId, p)
 }
 
 // 设置用户属性. 如果同名属性已存在，则用传入的属性覆盖同名属性.
 func (ta *TDAnalytics) UserSet(accountId string, distinctId string, properties map[string]interface{}) error {
-	return ta.user(accountId, distinctId, UserSet, properties)
+	return ta.user(context.Background(), accountId, distinctId, UserSet, properties)
+}
+
+// 设置用户属性, ctx 取消或超时时停止等待
+func (ta *TDAnalytics) UserSetCtx(ctx context.Context, accountId string, distinctId string, properties map[string]interface{}) error {
+	return ta.user(ctx, accountId, distinctId, UserSet, properties)
 }
 
 //删除用户属性
@@ -122,36 +155,36 @@ func (ta *TDAnalytics) UserUnset(accountId string, distinctId string, s []string
 	for _, v := range s {
 		prop[v] = 0
 	}
-	return ta.user(accountId, distinctId, UserUnset, prop)
+	return ta.user(context.Background(), accountId, distinctId, UserUnset, prop)
 }
 
 // 设置用户属性. 不会覆盖同名属性.
 func (ta *TDAnalytics) UserSetOnce(accountId string, distinctId string, properties map[string]interface{}) error {
-	return ta.user(accountId, distinctId, UserSetOnce, properties)
+	return ta.user(context.Background(), accountId, distinctId, UserSetOnce, properties)
 }
 
 // 对数值类型的属性做累加操作
 func (ta *TDAnalytics) UserAdd(accountId string, distinctId string, properties map[string]interface{}) error {
-	return ta.user(accountId, distinctId, UserAdd, properties)
+	return ta.user(context.Background(), accountId, distinctId, UserAdd, properties)
 }
 
 // 对数组类型的属性做追加加操作
 func (ta *TDAnalytics) UserAppend(accountId string, distinctId string, properties map[string]interface{}) error {
-	return ta.user(accountId, distinctId, UserAppend, properties)
+	return ta.user(context.Background(), accountId, distinctId, UserAppend, properties)
 }
 
 // 删除用户数据, 之后无法查看用户属性, 但是之前已经入库的事件数据不会被删除. 此操作不可逆
 func (ta *TDAnalytics) UserDelete(accountId string, distinctId string) error {
-	return ta.user(accountId, distinctId, UserDel, nil)
+	return ta.user(context.Background(), accountId, distinctId, UserDel, nil)
 }
 
-func (ta *TDAnalytics) user(accountId, distinctId, dataType string, properties map[string]interface{}) error {
+func (ta *TDAnalytics) user(ctx context.Context, accountId, distinctId, dataType string, properties map[string]interface{}) error {
 	if properties == nil && dataType != UserDel {
 		return errors.New("invalid params for " + dataType + ": properties is nil")
 	}
 	p := make(map[string]interface{})
 	mergeProperties(p, properties)
-	return ta.add(accountId, distinctId, dataType, "", "", p)
+	return ta.add(ctx, accountId, distinctId, dataType, "", "", p)
 }
 
 // 立即开始数据 IO 操作
@@ -159,12 +192,34 @@ func (ta *TDAnalytics) Flush() error {
 	return ta.consumer.Flush()
 }
 
+// 立即开始数据 IO 操作, ctx 取消或超时时停止等待
+func (ta *TDAnalytics) FlushCtx(ctx context.Context) error {
+	if c, ok := ta.consumer.(ContextConsumer); ok {
+		return c.FlushCtx(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ta.consumer.Flush()
+}
+
 // 关闭 TDAnalytics
 func (ta *TDAnalytics) Close()error {
 	return ta.consumer.Close()
 }
 
-func (ta *TDAnalytics) add(accountId, distinctId, dataType, eventName, eventId string, properties map[string]interface{}) error {
+// 关闭 TDAnalytics, ctx 取消或超时时放弃等待剩余数据
+func (ta *TDAnalytics) CloseCtx(ctx context.Context) error {
+	if c, ok := ta.consumer.(ContextConsumer); ok {
+		return c.CloseCtx(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ta.consumer.Close()
+}
+
+func (ta *TDAnalytics) add(ctx context.Context, accountId, distinctId, dataType, eventName, eventId string, properties map[string]interface{}) error {
 	if len(accountId) == 0 && len(distinctId) == 0 {
 		return errors.New("invalid paramters: account_id and distinct_id cannot be empty at the same time")
 	}
@@ -173,7 +228,14 @@ func (ta *TDAnalytics) add(accountId, distinctId, dataType, eventName, eventId s
 	ip := extractStringProperty(properties, "#ip")
 
 	// 获取 properties 中 time 值, 如不存在则返回当前时间
-	eventTime := extractTime(properties)
+	eventTime, offset := extractTime(properties, ta.location)
+
+	// 事件数据记录时区偏移, 用户数据不需要
+	if dataType == Track || dataType == TrackUpdate || dataType == TrackOverwrite {
+		if _, ok := properties["#zone_offset"]; !ok {
+			properties["#zone_offset"] = offset
+		}
+	}
 
 	firstCheckId := extractStringProperty(properties, "#first_check_id")
 
@@ -194,10 +256,19 @@ func (ta *TDAnalytics) add(accountId, distinctId, dataType, eventName, eventId s
 	}
 
 	// 检查数据格式, 并将时间类型数据转为符合格式要求的字符串
-	err := formatProperties(&data)
+	err := formatProperties(&data, ta.location)
 	if err != nil {
+		metrics().Counter(MetricValidationFailures, 1, dataType)
 		return err
 	}
 
-	return ta.consumer.Add(data)
+	if c, ok := ta.consumer.(ContextConsumer); ok {
+		err = c.AddCtx(ctx, data)
+	} else if err = ctx.Err(); err == nil {
+		err = ta.consumer.Add(data)
+	}
+	if err == nil {
+		metrics().Counter(MetricEventsAccepted, 1, dataType)
+	}
+	return err
 }
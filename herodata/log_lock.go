@@ -0,0 +1,65 @@
+package herodata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockFileName = ".herodata.lock" // MultiProcessLock 模式下日志目录中的锁文件
+
+var errLogFileChanged = errors.New("log file changed while compressing")
+
+// MultiProcessLock 模式下在文件锁内写入 p. 写入前确认当前文件没有被其他进程写满,
+// 也没有被压缩或删除, 否则重新扫描目录并切换到应写入的文件
+func (c *LogConsumer) lockedWrite(sink *logSink, p []byte) (int, error) {
+	if sink.lock == nil {
+		f, err := os.OpenFile(filepath.Join(sink.dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		sink.lock = f
+	}
+	if err := lockFile(sink.lock); err != nil {
+		return 0, fmt.Errorf("lock %q: %w", sink.lock.Name(), err)
+	}
+	defer unlockFile(sink.lock)
+
+	stat, err := sink.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(sink.file.Name())
+	moved := err != nil || !os.SameFile(info, stat)
+	full := sink.rotator.maxSize > 0 && stat.Size() > 0 && stat.Size()+int64(len(p)) > sink.rotator.maxSize
+	if moved || full {
+		if err := c.open(sink, sink.rotator.advance(int64(len(p)))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := sink.file.Write(p)
+	if stat, e := sink.file.Stat(); e == nil {
+		sink.rotator.reset(stat.Size())
+	}
+	return n, err
+}
+
+// 后台清理 Go 程压缩或删除文件时持有目录的文件锁, 避免其他进程正在写入该文件.
+// 非 MultiProcessLock 模式下直接执行 fn
+func (c *LogConsumer) withDirLock(dir string, fn func() error) error {
+	if c.multiProcess != MultiProcessLock {
+		return fn()
+	}
+	// 使用单独打开的文件描述符, 与本进程的写入 Go 程互斥
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("lock %q: %w", f.Name(), err)
+	}
+	defer unlockFile(f)
+	return fn()
+}
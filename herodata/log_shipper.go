@@ -0,0 +1,423 @@
+package herodata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultShipInterval   = time.Second              // 默认每秒扫描一次日志目录
+	DefaultCheckpointFile = ".herodata-shipper.json" // 默认的读取进度文件, 位于日志目录中
+)
+
+// LogShipperConfig LogShipper 的配置
+type LogShipperConfig struct {
+	// 写入日志目录的 LogConsumer 的配置, 用于识别日志文件. 设置为与 LogConfig 中同名字段相同的值
+	Log          LogSinkConfig
+	MultiProcess MultiProcessMode // 与 LogConfig.MultiProcess 相同, MultiProcessUniqueName 时读取所有进程的文件
+
+	ServerUrl string // 接收端地址, 按原样使用
+	AppId     string // 项目 APP ID
+	Protocol  string // 接收端协议, 默认 ProtocolHero
+	Compress  bool   // 是否使用 gzip 压缩数据
+
+	CheckpointFile string        // 保存每个文件已发送字节数的文件, 默认为日志目录中的 DefaultCheckpointFile
+	BatchSize      int           // 每次发送的最大条数, 默认 DefaultBatchSize, 最大 MaxBatchSize
+	Timeout        int           // 网络请求超时时间, 单位毫秒, 默认 DefaultTimeOut
+	Interval       time.Duration // 扫描日志目录的间隔, 默认 DefaultShipInterval
+
+	RetryPolicy *RetryPolicy // 发送失败后的重试策略, 为 nil 时使用 DefaultRetryPolicy. 重试次数用完后等下次扫描时再发送
+
+	OnError     func(err error, data []Data) // 发送失败、数据被接收端拒绝或日志行无法解析时回调
+	OnDelivered func(dest string, n int)     // 数据被接收端确认时回调
+}
+
+// LogShipper 读取 LogConsumer 写入的日志文件, 批量发送到 BatchConsumer 使用的接收端, 可以代替 Flume 等采集工具.
+// 每个文件已发送的字节数保存在 CheckpointFile 中, 重启后从上次的位置继续发送.
+// 发送成功但保存进度前进程退出时, 最多重复发送一批数据
+type LogShipper struct {
+	dir         string
+	matcher     *regexp.Regexp // 匹配日志文件, 第二个子匹配为压缩后缀
+	dest        *destination
+	compress    bool
+	checkpoint  string
+	batchSize   int
+	timeout     time.Duration
+	interval    time.Duration
+	retryPolicy RetryPolicy
+
+	mutex   sync.Mutex                 // 保护 offsets, 同一时间只有一个 Go 程发送
+	offsets map[string]*fileCheckpoint // 以文件名为键
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	errorCallback     func(err error, data []Data)
+	deliveredCallback func(dest string, n int)
+}
+
+// 一个日志文件的发送进度
+type fileCheckpoint struct {
+	Offset   int64 `json:"offset"`   // 已发送的字节数, 压缩文件为解压后的字节数
+	Complete bool  `json:"complete"` // 压缩后的文件已全部发送, 不会再有新数据
+}
+
+// 日志目录中的一个文件
+type shipFile struct {
+	name       string // 文件名
+	source     string // 压缩文件压缩前的文件名, 用于继承压缩前的发送进度
+	compressed bool
+	info       os.FileInfo
+}
+
+// 创建 LogShipper 并开始在后台发送日志目录中的数据
+func NewLogShipper(config LogShipperConfig) (*LogShipper, error) {
+	if config.Log.Directory == "" {
+		return nil, errors.New("directory can not be empty.")
+	}
+	if config.ServerUrl == "" {
+		return nil, errors.New("ServerUrl can not be empty.")
+	}
+	if config.MultiProcess == MultiProcessUniqueName {
+		config.Log.FileNameTemplate = uniqueFileNameTemplate(config.Log)
+	}
+	r, err := newRotator(config.Log, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := config.CheckpointFile
+	if checkpoint == "" {
+		checkpoint = filepath.Join(config.Log.Directory, DefaultCheckpointFile)
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if batchSize > MaxBatchSize {
+		batchSize = MaxBatchSize
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeOut
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultShipInterval
+	}
+	retryPolicy := DefaultRetryPolicy()
+	if config.RetryPolicy != nil {
+		retryPolicy = config.RetryPolicy.withDefaults()
+	}
+
+	s := &LogShipper{
+		dir:     config.Log.Directory,
+		matcher: r.pattern(`.+?`, `\d+`),
+		dest: newDestination(DestinationConfig{
+			ServerUrl: config.ServerUrl,
+			AppId:     config.AppId,
+			Protocol:  config.Protocol,
+		}),
+		compress:          config.Compress,
+		checkpoint:        checkpoint,
+		batchSize:         batchSize,
+		timeout:           time.Duration(timeout) * time.Millisecond,
+		interval:          interval,
+		retryPolicy:       retryPolicy,
+		offsets:           make(map[string]*fileCheckpoint),
+		done:              make(chan struct{}),
+		errorCallback:     config.OnError,
+		deliveredCallback: config.OnDelivered,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// 读取上次保存的发送进度
+func (s *LogShipper) load() error {
+	content, err := ioutil.ReadFile(s.checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, &s.offsets); err != nil {
+		return fmt.Errorf("checkpoint %q: %w", s.checkpoint, err)
+	}
+	return nil
+}
+
+// 保存发送进度, 先写入临时文件再替换, 避免进程退出时文件不完整
+func (s *LogShipper) save() error {
+	content, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	tmp := s.checkpoint + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.checkpoint)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("checkpoint %q: %w", s.checkpoint, err)
+	}
+	return nil
+}
+
+// 后台发送 Go 程, 每隔 interval 扫描一次目录, 关闭后退出
+func (s *LogShipper) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.done
+		cancel()
+	}()
+	for {
+		if err := s.Ship(ctx); err != nil && ctx.Err() == nil {
+			s.onError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Ship 立即发送日志目录中所有未发送的完整行, 遇到无法发送的数据时返回错误, 下次从该位置继续发送.
+// 后台发送时的错误回调 OnError
+func (s *LogShipper) Ship(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, err := s.list()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(files))
+	var shipErr error
+	for _, f := range files {
+		if shipErr == nil {
+			shipErr = s.shipFile(ctx, f)
+		}
+		seen[f.name] = true
+		// 压缩文件尚未开始发送时保留压缩前文件的进度
+		if f.compressed && s.offsets[f.name] == nil {
+			seen[f.source] = true
+		}
+	}
+	// 已被删除的文件不再记录进度
+	changed := false
+	for key := range s.offsets {
+		if !seen[key] {
+			delete(s.offsets, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil && shipErr == nil {
+			shipErr = err
+		}
+	}
+	return shipErr
+}
+
+// 日志目录中的日志文件, 按最后修改时间从早到晚排序. 只读取 gzip 压缩的文件, 忽略其他压缩格式
+func (s *LogShipper) list() ([]shipFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []shipFile
+	for _, info := range infos {
+		m := s.matcher.FindStringSubmatch(info.Name())
+		if info.IsDir() || m == nil || strings.HasSuffix(info.Name(), ".tmp") {
+			continue
+		}
+		f := shipFile{name: info.Name(), info: info}
+		if ext := m[len(m)-1]; ext != "" {
+			if !strings.HasSuffix(ext, ".gz") {
+				continue
+			}
+			// 包括同名文件已存在时压缩为 文件名.时间戳.gz 的文件
+			f.compressed = true
+			f.source = strings.TrimSuffix(info.Name(), ext)
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+	return files, nil
+}
+
+// 发送一个文件中未发送的完整行
+func (s *LogShipper) shipFile(ctx context.Context, f shipFile) error {
+	cp := s.offsets[f.name]
+	if cp == nil {
+		cp = &fileCheckpoint{}
+		// 压缩前已发送的部分不再发送
+		if src := s.offsets[f.source]; f.compressed && src != nil {
+			cp.Offset = src.Offset
+		}
+	}
+	if cp.Complete {
+		return nil
+	}
+	if !f.compressed {
+		if f.info.Size() == cp.Offset {
+			return nil
+		}
+		if f.info.Size() < cp.Offset {
+			// 同名文件被重新创建, 从头发送
+			cp.Offset = 0
+		}
+	}
+
+	file, err := os.Open(filepath.Join(s.dir, f.name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if f.compressed {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", f.name, err)
+		}
+		defer gr.Close()
+		if _, err := io.CopyN(ioutil.Discard, gr, cp.Offset); err != nil {
+			return fmt.Errorf("read %q: %w", f.name, err)
+		}
+		r = gr
+	} else if _, err := file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		lines, n, err := s.readBatch(reader, f.name)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read %q: %w", f.name, err)
+		}
+		if n > 0 {
+			if e := s.send(ctx, lines); e != nil {
+				return e
+			}
+			cp.Offset += n
+		}
+		if err == io.EOF {
+			// 压缩后的文件不会再写入, 末尾不完整的行也不会再补全
+			cp.Complete = f.compressed
+		}
+		if n > 0 || cp.Complete {
+			s.offsets[f.name] = cp
+			if e := s.save(); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// 读取最多 batchSize 个完整的行, 返回有效的行和读取的字节数. 读到文件末尾时返回 io.EOF,
+// 末尾没有换行符的行可能还在写入, 不计入读取的字节数
+func (s *LogShipper) readBatch(reader *bufio.Reader, name string) ([][]byte, int64, error) {
+	var lines [][]byte
+	var n int64
+	for count := 0; count < s.batchSize; count++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return lines, n, err
+		}
+		n += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			s.onError(fmt.Errorf("%w: %s: %q", ErrInvalidData, name, line), nil)
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, n, nil
+}
+
+// 发送一批数据, 失败时等待退避结束后重试. 被接收端拒绝的数据回调 OnError 后跳过, 重试次数用完后返回错误
+func (s *LogShipper) send(ctx context.Context, lines [][]byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	jdata := "[" + string(bytes.Join(lines, []byte{','})) + "]"
+	for {
+		if err := sleepCtx(ctx, s.dest.retryWait()); err != nil {
+			return err
+		}
+		result, re := s.dest.deliver(ctx, jdata, len(lines), s.timeout, s.compress, s.retryPolicy)
+		switch result {
+		case sendDelivered:
+			s.onDelivered(s.dest.name, len(lines))
+			return nil
+		case sendRejected:
+			// 被拒绝的数据不再重试, 继续发送后面的数据
+			s.onError(re, lines...)
+			return nil
+		case sendFailed:
+			return re
+		}
+	}
+}
+
+// Close 停止后台发送, 已发送的进度在每批数据发送后保存
+func (s *LogShipper) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+	return nil
+}
+
+// 回调 OnError, 未设置时打印到标准错误输出. lines 为相关的日志行
+func (s *LogShipper) onError(err error, lines ...[]byte) {
+	reportLines(s.errorCallback, err, lines)
+}
+
+func (s *LogShipper) onDelivered(dest string, n int) {
+	if s.deliveredCallback != nil {
+		s.deliveredCallback(dest, n)
+	}
+}
@@ -0,0 +1,141 @@
+package herodata
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的数据的接收端
+type shipReceiver struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *shipReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var batch []Data
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mutex.Lock()
+	for _, d := range batch {
+		r.events = append(r.events, d.EventName)
+	}
+	r.mutex.Unlock()
+	w.Write([]byte(`{"code":0}`))
+}
+
+func (r *shipReceiver) received() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func writeLogLines(t *testing.T, name string, compressed bool, events ...string) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if compressed {
+		gw := gzip.NewWriter(f)
+		defer gw.Close()
+		w = gw
+	}
+	for _, e := range events {
+		fmt.Fprintf(w, "{\"#event_name\":%q}\n", e)
+	}
+}
+
+// 同名压缩文件已存在时压缩为 文件名.时间戳.gz, 压缩前已发送的数据不会重复发送
+func TestLogShipperCompressedWithTimestamp(t *testing.T) {
+	receiver := &shipReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "log.2024-01-01")
+	writeLogLines(t, name, false, "a", "b")
+
+	shipper, err := NewLogShipper(LogShipperConfig{Log: LogSinkConfig{Directory: dir}, ServerUrl: server.URL, AppId: "ship", Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shipper.Close()
+	if err := shipper.Ship(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 追加一行后压缩
+	writeLogLines(t, fmt.Sprintf("%s.%d.gz", name, time.Now().UnixNano()), true, "a", "b", "c")
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := shipper.Ship(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := shipper.Ship(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(receiver.received()); got != "[a b c]" {
+		t.Fatalf("got %s, want [a b c]", got)
+	}
+}
+
+// 后台发送失败时回调 OnError
+func TestLogShipperReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeLogLines(t, filepath.Join(dir, "log.2024-01-01"), false, "a")
+
+	errs := make(chan error, 10)
+	shipper, err := NewLogShipper(LogShipperConfig{
+		Log:         LogSinkConfig{Directory: dir},
+		ServerUrl:   server.URL,
+		Interval:    10 * time.Millisecond,
+		RetryPolicy: &RetryPolicy{MaxAttempts: 1, BaseBackoff: time.Millisecond},
+		OnError: func(err error, data []Data) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shipper.Close()
+
+	select {
+	case err := <-errs:
+		var re *ReceiverError
+		if !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("got %v, want ReceiverError with status 503", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError not called")
+	}
+	// 未发送的数据保留在文件中, 进度不变
+	content, _ := ioutil.ReadFile(filepath.Join(dir, DefaultCheckpointFile))
+	if len(content) > 0 && string(content) != "{}" {
+		t.Fatalf("checkpoint %s", content)
+	}
+}
@@ -0,0 +1,485 @@
+package herodata
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+const logBatchSize = 256 // 写入 Go 程每次从信道中最多连续读取的条数
+
+// LogHealth 日志输出目录的健康状态
+type LogHealth struct {
+	Directory string    // 日志目录
+	Healthy   bool      // 是否可以正常写入
+	LastError error     // 最近一次打开或写入失败的原因, 恢复后为 nil
+	Since     time.Time // 进入降级状态的时间
+	Buffered  int       // 降级期间暂存在内存中等待写入的条数
+}
+
+// 一个日志输出目录. 数据先写入缓冲区 w, 再批量写入文件.
+// 写入失败后进入降级状态, 数据暂存在 pending 中, 按退避时间重试
+type logSink struct {
+	dir       string
+	rotator   *rotator
+	retention LogRetention
+	file      *os.File
+	lock      *os.File      // MultiProcessLock 模式下的锁文件
+	w         *bufio.Writer // 文件的写缓冲区
+	buffered  int           // 缓冲区中尚未写入文件的条数
+	unwritten []byte        // 写入文件失败时未写入的完整行, 转入 pending
+	partial   string        // 末尾有写入一半的行的文件, 重新打开时先补一个换行符
+	detached  bool          // 当前文件已被删除或移走且无法重新打开, 缓冲区中的数据直接转入 unwritten
+	active    string        // 正在写入的文件, 由 healthMutex 保护, 不会被压缩或删除
+	unsynced  int           // 上次同步后写入的条数
+	pending   [][]byte      // 降级期间暂存的数据, 每项为一行
+	err       error         // 降级原因, nil 表示正常
+	attempt   int           // 连续失败次数
+	retryAt   time.Time     // 下次重试的时间
+	health    LogHealth     // 由 healthMutex 保护, 供 Health 读取
+}
+
+// 缓冲区的底层写入器. 写入文件失败时将未写入的完整行保存到 unwritten
+type lineWriter struct {
+	c    *LogConsumer
+	sink *logSink
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	if w.sink.detached {
+		w.sink.unwritten = append(w.sink.unwritten, p...)
+		return 0, os.ErrNotExist
+	}
+	var n int
+	var err error
+	if w.c.multiProcess == MultiProcessLock {
+		n, err = w.c.lockedWrite(w.sink, p)
+	} else {
+		n, err = w.sink.file.Write(p)
+	}
+	if err != nil {
+		start := bytes.LastIndexByte(p[:n], '\n') + 1
+		w.sink.unwritten = append(w.sink.unwritten, p[start:]...)
+		if n > start {
+			w.sink.partial = w.sink.file.Name()
+		}
+	}
+	return n, err
+}
+
+// Health 返回每个日志目录的健康状态. 写入失败时数据会暂存在内存中并在后台重试,
+// 期间 Healthy 为 false
+func (c *LogConsumer) Health() []LogHealth {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	health := make([]LogHealth, 0, len(c.sinks))
+	for _, sink := range c.sinks {
+		health = append(health, sink.health)
+	}
+	return health
+}
+
+func (c *LogConsumer) newSink(config LogSinkConfig) *logSink {
+	r, _ := newRotator(config, c.now) // 配置已在 NewLogConsumerWithConfig 中校验
+	sink := &logSink{
+		dir:       config.Directory,
+		rotator:   r,
+		retention: config.Retention,
+	}
+	sink.w = bufio.NewWriterSize(lineWriter{c, sink}, c.bufferSize)
+	return sink
+}
+
+// 写入 Go 程, 信道关闭后退出
+func (c *LogConsumer) run() {
+	defer func() {
+		for _, sink := range c.sinks {
+			if sink.file != nil {
+				sink.file.Sync()
+				sink.file.Close()
+			}
+			if sink.lock != nil {
+				sink.lock.Close()
+			}
+		}
+		close(c.stopped)
+		c.wg.Done()
+	}()
+
+	flushTicker := time.NewTicker(c.flushInterval)
+	defer flushTicker.Stop()
+	var syncTick <-chan time.Time
+	if c.syncPolicy == SyncInterval {
+		ticker := time.NewTicker(c.syncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+
+	for {
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait, ok := c.retryWait(); ok {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+
+		select {
+		case entry, ok := <-c.ch:
+			if timer != nil {
+				timer.Stop()
+			}
+			// 批量读取信道中已有的数据, 信道读空后再将缓冲区写入文件
+			for i := 0; ; i++ {
+				if !ok {
+					c.shutdown()
+					return
+				}
+				c.handle(entry)
+				if i+1 >= logBatchSize {
+					break
+				}
+				select {
+				case entry, ok = <-c.ch:
+					continue
+				default:
+				}
+				break
+			}
+			metrics().Gauge(MetricLogChannelDepth, float64(len(c.ch)), c.directory)
+			if len(c.ch) == 0 {
+				c.flushBuffers()
+			}
+		case <-flushTicker.C:
+			c.flushBuffers()
+		case <-syncTick:
+			c.syncAll()
+		case <-retry:
+			now := time.Now()
+			for _, sink := range c.sinks {
+				if sink.err != nil && !now.Before(sink.retryAt) {
+					c.recover(sink)
+				}
+			}
+		}
+	}
+}
+
+// 处理信道中的一项
+func (c *LogConsumer) handle(entry logEntry) {
+	if entry.done != nil {
+		entry.done <- c.syncAll()
+		return
+	}
+	for _, sink := range c.sinks {
+		c.write(sink, entry.line.Bytes())
+	}
+	putLine(entry.line)
+}
+
+// 距离最近一次重试的等待时间, 没有降级的目录时返回 false
+func (c *LogConsumer) retryWait() (time.Duration, bool) {
+	var next time.Time
+	for _, sink := range c.sinks {
+		if sink.err != nil && (next.IsZero() || sink.retryAt.Before(next)) {
+			next = sink.retryAt
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return time.Until(next), true
+}
+
+// 写入一行, 失败时该目录进入降级状态, 数据暂存在内存中
+func (c *LogConsumer) write(sink *logSink, line []byte) {
+	if sink.err != nil {
+		c.buffer(sink, line)
+		return
+	}
+	if err := c.writeLine(sink, line); err != nil {
+		c.degrade(sink, err)
+		return
+	}
+	sink.unsynced++
+	if c.syncPolicy == SyncAlways || (c.syncPolicy == SyncEveryN && sink.unsynced >= c.syncEvery) {
+		c.sync(sink)
+	}
+}
+
+// 按需切分文件并将一行写入缓冲区. 失败时未写入文件的数据都保存在 unwritten 中
+func (c *LogConsumer) writeLine(sink *logSink, line []byte) error {
+	if err := c.rotate(sink, int64(len(line))); err != nil {
+		sink.unwritten = append(sink.unwritten, line...)
+		return err
+	}
+	// 缓冲区放不下时先写入文件, 保证缓冲区中只有完整的行
+	if len(line) > sink.w.Available() && sink.w.Buffered() > 0 {
+		if err := c.flushBuffer(sink); err != nil {
+			sink.unwritten = append(sink.unwritten, line...)
+			return err
+		}
+	}
+	// 缓冲区为空且数据大于缓冲区时直接写入文件, 失败时由 lineWriter 保存
+	if _, err := sink.w.Write(line); err != nil {
+		return fmt.Errorf("LoggerWriter(%q): %w", sink.dir, err)
+	}
+	sink.rotator.written(int64(len(line)))
+	metrics().Counter(MetricLogBytesWritten, float64(len(line)), sink.file.Name())
+	sink.buffered++
+	if sink.w.Buffered() == 0 {
+		c.onDelivered(sink.dir, sink.buffered)
+		sink.buffered = 0
+	}
+	return nil
+}
+
+// 将缓冲区写入文件
+func (c *LogConsumer) flushBuffer(sink *logSink) error {
+	if sink.w.Buffered() == 0 {
+		return nil
+	}
+	if err := c.reopenIfMoved(sink); err != nil {
+		// 不再写入已删除的文件, 缓冲区中的数据转入 unwritten, 降级后暂存在内存中
+		sink.detached = true
+		sink.w.Flush()
+		sink.detached = false
+		return fmt.Errorf("LoggerWriter(%q): %w", sink.dir, err)
+	}
+	if err := sink.w.Flush(); err != nil {
+		// 部分行可能已经写入文件
+		if delivered := sink.buffered - bytes.Count(sink.unwritten, []byte{'\n'}); delivered > 0 {
+			c.onDelivered(sink.dir, delivered)
+		}
+		sink.buffered = 0
+		return fmt.Errorf("LoggerWriter(%q): %w", sink.dir, err)
+	}
+	c.onDelivered(sink.dir, sink.buffered)
+	sink.buffered = 0
+	return nil
+}
+
+// 当前文件或目录被外部删除、移动(如 logrotate)时, 重新创建目录并打开同名文件,
+// 避免数据写入已删除的文件. MultiProcessLock 模式下由 lockedWrite 判断
+func (c *LogConsumer) reopenIfMoved(sink *logSink) error {
+	if sink.file == nil || c.multiProcess == MultiProcessLock {
+		return nil
+	}
+	stat, err := sink.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(sink.file.Name()); err == nil && os.SameFile(info, stat) {
+		return nil
+	}
+	if err := os.MkdirAll(sink.dir, os.ModePerm); err != nil {
+		return err
+	}
+	return c.open(sink, sink.file.Name())
+}
+
+// 将所有目录的缓冲区写入文件
+func (c *LogConsumer) flushBuffers() {
+	for _, sink := range c.sinks {
+		if sink.err != nil {
+			continue
+		}
+		if err := c.flushBuffer(sink); err != nil {
+			c.degrade(sink, err)
+		}
+	}
+}
+
+// 同步所有目录的文件, 返回第一个错误
+func (c *LogConsumer) syncAll() error {
+	var first error
+	for _, sink := range c.sinks {
+		if err := c.sync(sink); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// 将缓冲区写入文件并同步到磁盘. 处于降级状态时暂存的数据无法同步, 返回 ErrLogUnavailable
+func (c *LogConsumer) sync(sink *logSink) error {
+	if sink.err == nil {
+		if err := c.flushBuffer(sink); err != nil {
+			c.degrade(sink, err)
+		}
+	}
+	if sink.err != nil {
+		return fmt.Errorf("%w %s: %s", ErrLogUnavailable, sink.dir, sink.err)
+	}
+	if sink.file == nil || sink.unsynced == 0 {
+		return nil
+	}
+	if err := sink.file.Sync(); err != nil {
+		err = fmt.Errorf("sync %q: %w", sink.file.Name(), err)
+		c.onError(err)
+		return err
+	}
+	sink.unsynced = 0
+	return nil
+}
+
+// 写入 n 字节前判断是否要切分日志, 需要时关闭当前文件并打开新文件
+func (c *LogConsumer) rotate(sink *logSink, n int64) error {
+	name := sink.rotator.next(n)
+	if sink.file != nil && sink.file.Name() == name {
+		return nil
+	}
+
+	if err := c.flushBuffer(sink); err != nil {
+		return err
+	}
+	return c.open(sink, name)
+}
+
+// 打开 name 并关闭当前文件. 打开失败时保留当前文件, 由调用方进入降级状态
+func (c *LogConsumer) open(sink *logSink, name string) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open failed: %w", err)
+	}
+	if sink.partial == name {
+		// 结束上次写入一半的行, 避免与下一行连在一起
+		if _, err := fd.Write([]byte{'\n'}); err != nil {
+			fd.Close()
+			return fmt.Errorf("LoggerWriter(%q): %w", name, err)
+		}
+	}
+	if sink.file != nil {
+		if c.syncPolicy != SyncNever {
+			sink.file.Sync()
+		}
+		sink.file.Close()
+		sink.unsynced = 0
+	}
+	sink.partial = ""
+	sink.file = fd
+	if stat, err := fd.Stat(); err == nil {
+		sink.rotator.reset(stat.Size())
+	}
+
+	c.healthMutex.Lock()
+	rotated := sink.active != "" && sink.active != name
+	sink.active = name
+	c.healthMutex.Unlock()
+	if rotated && c.rotated != nil {
+		c.notifyRotated()
+	}
+	return nil
+}
+
+// 进入降级状态, 未写入文件的数据转入 pending, 并回调 OnError
+func (c *LogConsumer) degrade(sink *logSink, err error) {
+	c.closeFile(sink)
+	first := sink.err == nil
+	sink.err = err
+	sink.attempt = 1
+	sink.retryAt = time.Now().Add(c.retryPolicy.backoff(sink.attempt, 0))
+
+	c.healthMutex.Lock()
+	if first {
+		sink.health.Since = time.Now()
+	}
+	sink.health.Healthy = false
+	sink.health.LastError = err
+	c.healthMutex.Unlock()
+
+	c.onError(fmt.Errorf("%w %s: %s", ErrLogUnavailable, sink.dir, err))
+}
+
+// 关闭出错的文件, 丢弃缓冲区并将未写入的数据转入 pending
+func (c *LogConsumer) closeFile(sink *logSink) {
+	if sink.file != nil {
+		sink.file.Close()
+		sink.file = nil
+	}
+	if sink.lock != nil {
+		sink.lock.Close()
+		sink.lock = nil
+	}
+	sink.w.Reset(lineWriter{c, sink})
+	sink.buffered = 0
+	unwritten := sink.unwritten
+	sink.unwritten = nil
+	for len(unwritten) > 0 {
+		i := bytes.IndexByte(unwritten, '\n') + 1
+		if i == 0 {
+			i = len(unwritten)
+		}
+		c.buffer(sink, unwritten[:i])
+		unwritten = unwritten[i:]
+	}
+}
+
+// 暂存写入失败的数据, 超出上限时丢弃最早的数据
+func (c *LogConsumer) buffer(sink *logSink, line []byte) {
+	if len(sink.pending) >= c.maxBuffered {
+		c.drop(ErrCacheFull, sink.pending[0])
+		sink.pending = sink.pending[1:]
+	}
+	sink.pending = append(sink.pending, append([]byte(nil), line...))
+
+	c.healthMutex.Lock()
+	sink.health.Buffered = len(sink.pending)
+	c.healthMutex.Unlock()
+}
+
+// 重新创建目录、打开文件并写入暂存的数据. 失败时按退避时间等待下次重试
+func (c *LogConsumer) recover(sink *logSink) bool {
+	pending := sink.pending
+	sink.pending = nil
+	rest := pending // 尚未尝试写入的数据
+	err := os.MkdirAll(sink.dir, os.ModePerm)
+	if err == nil {
+		for i, line := range pending {
+			if err = c.writeLine(sink, line); err != nil {
+				rest = pending[i+1:]
+				break
+			}
+			sink.unsynced++
+		}
+	}
+	if err == nil {
+		rest = nil
+		err = c.flushBuffer(sink)
+	}
+	if err != nil {
+		// 未写入文件的数据在前, 尚未尝试写入的数据在后
+		c.closeFile(sink)
+		for _, line := range rest {
+			c.buffer(sink, line)
+		}
+	}
+
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	sink.health.Buffered = len(sink.pending)
+	if err != nil {
+		sink.err = err
+		sink.attempt++
+		sink.retryAt = time.Now().Add(c.retryPolicy.backoff(sink.attempt, 0))
+		sink.health.LastError = err
+		return false
+	}
+	sink.err = nil
+	sink.attempt = 0
+	sink.health = LogHealth{Directory: sink.dir, Healthy: true}
+	return true
+}
+
+// 信道关闭后写入缓冲区, 并最后尝试一次写入暂存的数据, 仍然失败的数据回调 OnError
+func (c *LogConsumer) shutdown() {
+	c.flushBuffers()
+	for _, sink := range c.sinks {
+		if sink.err == nil || c.recover(sink) {
+			continue
+		}
+		c.onError(fmt.Errorf("%w: %s", ErrConsumerClosed, sink.err), sink.pending...)
+		sink.pending = nil
+	}
+}
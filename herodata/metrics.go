@@ -0,0 +1,134 @@
+package herodata
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics 为 SDK 的监控指标接口, 可对接 Prometheus client_golang、expvar 等.
+// labelValues 的顺序与 MetricDescs 中对应指标的 Labels 一致
+type Metrics interface {
+	Counter(name string, delta float64, labelValues ...string)   // 累加计数
+	Gauge(name string, value float64, labelValues ...string)     // 设置当前值
+	Histogram(name string, value float64, labelValues ...string) // 记录一次观测值
+}
+
+// 指标名称
+const (
+	MetricEventsAccepted     = "herodata_events_accepted_total"       // TDAnalytics 接受的数据条数
+	MetricValidationFailures = "herodata_validation_failures_total"   // 数据格式校验失败次数
+	MetricBatchesSent        = "herodata_batches_sent_total"          // 发送成功的批次数
+	MetricBatchesFailed      = "herodata_batches_failed_total"        // 发送失败的批次数(重试耗尽或被接收端拒绝)
+	MetricRetries            = "herodata_retries_total"               // 重试次数
+	MetricCacheDropped       = "herodata_cache_dropped_batches_total" // 缓存溢出被丢弃的批次数
+	MetricSendLatency        = "herodata_send_latency_seconds"        // 单次发送耗时
+	MetricLogChannelDepth    = "herodata_log_channel_depth"           // LogConsumer 信道中等待写入的条数
+	MetricLogBytesWritten    = "herodata_log_bytes_written_total"     // 写入日志文件的字节数
+)
+
+// 指标类型
+const (
+	MetricKindCounter   = "counter"
+	MetricKindGauge     = "gauge"
+	MetricKindHistogram = "histogram"
+)
+
+// MetricDesc 指标描述, 用于在 Prometheus 等系统中预先注册指标
+type MetricDesc struct {
+	Name   string
+	Kind   string
+	Help   string
+	Labels []string
+}
+
+// MetricDescs SDK 上报的所有指标
+var MetricDescs = []MetricDesc{
+	{MetricEventsAccepted, MetricKindCounter, "Events accepted by TDAnalytics.", []string{"type"}},
+	{MetricValidationFailures, MetricKindCounter, "Events rejected by property validation.", []string{"type"}},
+	{MetricBatchesSent, MetricKindCounter, "Batches acknowledged by the receiver.", []string{"destination"}},
+	{MetricBatchesFailed, MetricKindCounter, "Batches that failed after retries or were rejected.", []string{"destination"}},
+	{MetricRetries, MetricKindCounter, "Send retries.", []string{"destination"}},
+	{MetricCacheDropped, MetricKindCounter, "Batches dropped because the destination cache was full.", []string{"destination"}},
+	{MetricSendLatency, MetricKindHistogram, "Latency of a single send to the receiver in seconds.", []string{"destination"}},
+	{MetricLogChannelDepth, MetricKindGauge, "Records waiting in the LogConsumer channel.", []string{"directory"}},
+	{MetricLogBytesWritten, MetricKindCounter, "Bytes written to log files.", []string{"file"}},
+}
+
+type metricsHolder struct {
+	m Metrics
+}
+
+var currentMetrics atomic.Value
+
+func init() {
+	currentMetrics.Store(metricsHolder{nopMetrics{}})
+}
+
+// SetMetrics 设置 SDK 使用的监控指标实现, 传入 nil 时关闭指标上报
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	currentMetrics.Store(metricsHolder{m})
+}
+
+func metrics() Metrics {
+	return currentMetrics.Load().(metricsHolder).m
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Counter(string, float64, ...string)   {}
+func (nopMetrics) Gauge(string, float64, ...string)     {}
+func (nopMetrics) Histogram(string, float64, ...string) {}
+
+// ExpvarMetrics 将指标发布到 expvar, 可通过 /debug/vars 查看.
+// 每个指标为一个 expvar.Map, key 为以逗号连接的标签值. 直方图记录 count 和 sum
+type ExpvarMetrics struct {
+	mutex sync.Mutex
+	vars  map[string]*expvar.Map
+}
+
+// NewExpvarMetrics 创建 ExpvarMetrics. 同名的 expvar 变量已存在时复用
+func NewExpvarMetrics() *ExpvarMetrics {
+	return &ExpvarMetrics{vars: make(map[string]*expvar.Map)}
+}
+
+func (e *ExpvarMetrics) getMap(name string) *expvar.Map {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if m, ok := e.vars[name]; ok {
+		return m
+	}
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		m = expvar.NewMap(name)
+	}
+	e.vars[name] = m
+	return m
+}
+
+func (e *ExpvarMetrics) Counter(name string, delta float64, labelValues ...string) {
+	e.getMap(name).AddFloat(strings.Join(labelValues, ","), delta)
+}
+
+func (e *ExpvarMetrics) Gauge(name string, value float64, labelValues ...string) {
+	m := e.getMap(name)
+	key := strings.Join(labelValues, ",")
+	if v, ok := m.Get(key).(*expvar.Float); ok {
+		v.Set(value)
+		return
+	}
+	v := new(expvar.Float)
+	v.Set(value)
+	m.Set(key, v)
+}
+
+func (e *ExpvarMetrics) Histogram(name string, value float64, labelValues ...string) {
+	m := e.getMap(name)
+	key := strings.Join(labelValues, ",")
+	m.AddFloat(key+":count", 1)
+	m.AddFloat(key+":sum", value)
+}
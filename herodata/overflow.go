@@ -0,0 +1,14 @@
+package herodata
+
+// OverflowPolicy 队列已满时的处理方式
+type OverflowPolicy int32
+
+const (
+	OverflowBlock      OverflowPolicy = 0 // 阻塞等待队列有空位
+	OverflowDropNewest OverflowPolicy = 1 // 丢弃新数据
+	OverflowDropOldest OverflowPolicy = 2 // 丢弃队列中最早的数据
+	OverflowError      OverflowPolicy = 3 // 丢弃新数据并返回 ErrQueueFull
+
+	// OverflowBlockTimeout 最多阻塞 LogConfig.BlockTimeout, 超时后丢弃新数据并返回 ErrQueueFull. 仅 LogConsumer 支持, BatchConsumer 创建时返回错误
+	OverflowBlockTimeout OverflowPolicy = 4
+)
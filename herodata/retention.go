@@ -0,0 +1,204 @@
+package herodata
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	retentionInterval = time.Minute      // 按 MaxAge 清理旧文件的检查间隔
+	foreignIdle       = 10 * time.Minute // 其他进程的文件超过该时间没有写入才会被压缩或删除
+)
+
+// LogCompressor 压缩切分后不再写入的日志文件. 需要 zstd 等格式时可基于第三方库实现该接口
+type LogCompressor interface {
+	Extension() string                             // 压缩后文件名的后缀, 如 ".gz"
+	NewWriter(w io.Writer) (io.WriteCloser, error) // 创建压缩写入器, Close 时写入剩余数据
+}
+
+// GzipCompressor 使用 gzip 压缩日志文件
+var GzipCompressor LogCompressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Extension() string {
+	return ".gz"
+}
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// LogRetention 切分后旧日志文件的压缩和保留策略, 在后台执行, 不阻塞写入.
+// 正在写入的文件不会被压缩或删除. MultiProcessUniqueName 模式下也处理其他进程的文件, 其中 10 分钟内有写入的未压缩文件视为正在写入
+type LogRetention struct {
+	Compressor   LogCompressor // 压缩旧文件, 为 nil 时不压缩
+	MaxAge       time.Duration // 删除最后修改时间早于 MaxAge 的旧文件, 0 表示不限制
+	MaxTotalSize int           // 日志文件总大小上限, 单位 MB, 超出后从最早的文件开始删除, 0 表示不限制
+	MaxFiles     int           // 最多保留的日志文件个数, 超出后从最早的文件开始删除, 0 表示不限制
+}
+
+func (r LogRetention) enabled() bool {
+	return r.Compressor != nil || r.MaxAge > 0 || r.MaxTotalSize > 0 || r.MaxFiles > 0
+}
+
+// 后台清理 Go 程, 文件切分后及每隔 retentionInterval 执行一次, 写入 Go 程退出后退出
+func (c *LogConsumer) janitor() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		for _, sink := range c.sinks {
+			if sink.retention.enabled() {
+				c.cleanup(sink)
+			}
+		}
+		select {
+		case <-c.rotated:
+		case <-ticker.C:
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
+// 通知后台清理 Go 程有文件被切分
+func (c *LogConsumer) notifyRotated() {
+	select {
+	case c.rotated <- struct{}{}:
+	default:
+	}
+}
+
+// 压缩并清理一个日志目录中的旧文件
+func (c *LogConsumer) cleanup(sink *logSink) {
+	c.healthMutex.Lock()
+	active := sink.active
+	c.healthMutex.Unlock()
+
+	infos, err := ioutil.ReadDir(sink.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.IsDir() || !sink.rotator.owns(info.Name()) || strings.HasSuffix(info.Name(), ".tmp") {
+			continue
+		}
+		// 其他进程的文件最近仍有写入时视为正在写入, 已退出进程的文件按同样的策略压缩和清理
+		if sink.rotator.foreign(info.Name()) && time.Since(info.ModTime()) < foreignIdle {
+			continue
+		}
+		files = append(files, info)
+	}
+
+	if compressor := sink.retention.Compressor; compressor != nil {
+		for i, info := range files {
+			name := filepath.Join(sink.dir, info.Name())
+			if name == active || strings.HasSuffix(name, compressor.Extension()) {
+				continue
+			}
+			compressed, err := compressLogFile(name, compressor, func(fn func() error) error {
+				return c.withDirLock(sink.dir, fn)
+			})
+			if errors.Is(err, errLogFileChanged) {
+				continue // 其他进程仍在写入, 下次再压缩
+			}
+			if err != nil {
+				c.onError(fmt.Errorf("compress %q: %w", name, err))
+				continue
+			}
+			files[i] = compressed
+		}
+	}
+
+	// 按最后修改时间从早到晚排序, 依次删除过期或超出上限的文件
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	var total int64
+	for _, info := range files {
+		total += info.Size()
+	}
+	count := len(files)
+	maxSize := int64(sink.retention.MaxTotalSize) * 1024 * 1024
+	for _, info := range files {
+		expired := sink.retention.MaxAge > 0 && time.Since(info.ModTime()) > sink.retention.MaxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) && (sink.retention.MaxFiles <= 0 || count <= sink.retention.MaxFiles) {
+			break
+		}
+		name := filepath.Join(sink.dir, info.Name())
+		if name == active {
+			continue
+		}
+		if err := c.withDirLock(sink.dir, func() error { return os.Remove(name) }); err != nil {
+			c.onError(fmt.Errorf("remove %q: %w", name, err))
+			continue
+		}
+		total -= info.Size()
+		count--
+	}
+}
+
+// 压缩文件并删除原文件, 压缩后的文件保留原文件的修改时间.
+// 替换原文件时在 guard 内确认原文件在压缩期间没有被写入, 否则返回 errLogFileChanged
+func compressLogFile(name string, compressor LogCompressor, guard func(fn func() error) error) (os.FileInfo, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := name + compressor.Extension()
+	if _, err := os.Stat(dst); err == nil {
+		// 不按大小切分时, 进程重启后可能再次写入同名文件, 避免覆盖已压缩的文件
+		dst = fmt.Sprintf("%s.%d%s", name, time.Now().UnixNano(), compressor.Extension())
+	}
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w, err := compressor.NewWriter(f)
+	if err == nil {
+		if _, err = io.Copy(w, src); err == nil {
+			err = w.Close()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = guard(func() error {
+			if now, err := os.Stat(name); err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+				return errLogFileChanged
+			}
+			if err := os.Rename(tmp, dst); err != nil {
+				return err
+			}
+			os.Remove(name)
+			return nil
+		})
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return os.Stat(dst)
+}
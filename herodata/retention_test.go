@@ -0,0 +1,54 @@
+package herodata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// MultiProcessUniqueName 模式下压缩和清理已退出进程的文件, 不处理其他进程正在写入的文件
+func TestLogRetentionOtherProcesses(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string, age time.Duration) string {
+		t.Helper()
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	stale := touch("log.2024-01-01.99999", time.Hour)
+	expired := touch("log.2023-12-01.99998.gz", 48*time.Hour)
+	live := touch("log.2024-01-02.99997", time.Second)
+
+	consumer, err := NewLogConsumerWithConfig(LogConfig{
+		Directory:    dir,
+		MultiProcess: MultiProcessUniqueName,
+		Retention:    LogRetention{Compressor: GzipCompressor, MaxAge: 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for exists(stale) || !exists(stale+".gz") || exists(expired) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale %v, compressed %v, expired %v", exists(stale), exists(stale+".gz"), exists(expired))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !exists(live) {
+		t.Fatal("file of a live process was removed")
+	}
+}
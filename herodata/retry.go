@@ -0,0 +1,141 @@
+package herodata
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy 发送失败时的重试策略
+type RetryPolicy struct {
+	MaxAttempts      int           // 每批数据的最大尝试次数(包含第一次), 达到后回调 OnError, 默认 3
+	BaseBackoff      time.Duration // 第一次重试前的等待时间, 之后每次翻倍, 默认 200 毫秒
+	MaxBackoff       time.Duration // 最长等待时间, 默认 10 秒
+	Jitter           float64       // 等待时间的随机浮动比例, 取值 0~1, 0 表示不浮动
+	RetryableStatus  []int         // 可重试的 HTTP 状态码, 为 nil 时使用默认值. 网络错误总是重试
+	RetryableCodes   []int         // 可重试的接收端 code, 默认不重试. 其他非 0 的 code 视为数据错误直接丢弃
+	IgnoreRetryAfter bool          // 忽略接收端返回的 Retry-After, 默认按 Retry-After 等待(不超过 MaxBackoff)
+}
+
+const (
+	DefaultMaxAttempts = 3
+	DefaultBaseBackoff = 200 * time.Millisecond
+	DefaultMaxBackoff  = 10 * time.Second
+	DefaultJitter      = 0.2
+)
+
+// 默认可重试的 HTTP 状态码
+var defaultRetryableStatus = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultRetryPolicy 返回默认的重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     DefaultMaxAttempts,
+		BaseBackoff:     DefaultBaseBackoff,
+		MaxBackoff:      DefaultMaxBackoff,
+		Jitter:          DefaultJitter,
+		RetryableStatus: defaultRetryableStatus,
+	}
+}
+
+// 补全未设置的字段
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = DefaultBaseBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.MaxBackoff < p.BaseBackoff {
+		p.MaxBackoff = p.BaseBackoff
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if p.RetryableStatus == nil {
+		p.RetryableStatus = defaultRetryableStatus
+	}
+	return p
+}
+
+func (p RetryPolicy) retryableStatus(statusCode int) bool {
+	return containsInt(p.RetryableStatus, statusCode)
+}
+
+func (p RetryPolicy) retryableCode(code int) bool {
+	return containsInt(p.RetryableCodes, code)
+}
+
+// 第 attempt 次失败后的等待时间, attempt 从 1 开始
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 && !p.IgnoreRetryAfter {
+		if retryAfter > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+		return retryAfter
+	}
+
+	d := p.BaseBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// 等待 d, ctx 取消或超时时提前返回 ctx.Err()
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 解析 Retry-After 响应头, 支持秒数和 HTTP 日期两种格式
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package herodata
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 文件名模板中可以使用的占位符
+const (
+	TemplatePrefix   = "{prefix}"   // 日志文件前缀名
+	TemplateTime     = "{time}"     // 当前切分时间段的开始时间
+	TemplateIndex    = "{index}"    // 按大小切分时的序号
+	TemplateHostname = "{hostname}" // 主机名
+	TemplatePid      = "{pid}"      // 进程号
+	TemplateAppId    = "{appid}"    // LogConfig.AppId
+)
+
+// 日志文件切分器, 根据当前时间和文件大小决定写入的文件.
+// 默认文件名为 目录/前缀.log.时间, 开启按大小切分时为 目录/前缀.log.时间_序号
+type rotator struct {
+	dir        string           // 日志目录
+	interval   time.Duration    // 按时间切分的间隔, 0 表示只按大小切分
+	dateFormat string           // 时间段的格式
+	maxSize    int64            // 单个日志文件大小上限, 单位 Byte, 0 表示不按大小切分
+	template   string           // 文件名模板, 除 {time} {index} {pid} 外的占位符已替换
+	pid        string           // 当前进程号
+	owned      *regexp.Regexp   // 匹配该切分器及使用同一模板的其他进程创建的文件, 包括压缩后的文件
+	mine       *regexp.Regexp   // 只匹配当前进程创建的文件
+	now        func() time.Time // 当前时间, 可替换为假时钟
+
+	started bool   // 是否已扫描过目录
+	period  string // 当前文件对应的时间
+	index   int    // 当前文件的序号
+	size    int64  // 当前文件大小
+}
+
+func newRotator(config LogSinkConfig, now func() time.Time) (*rotator, error) {
+	if now == nil {
+		now = time.Now
+	}
+	r := &rotator{
+		dir:     config.Directory,
+		maxSize: int64(config.FileSize) * 1024 * 1024,
+		now:     now,
+	}
+
+	switch {
+	case config.RotateInterval > 0:
+		r.interval = config.RotateInterval
+	case config.RotateMode == ROTATE_DAILY:
+		r.interval = 24 * time.Hour
+	case config.RotateMode == ROTATE_HOURLY:
+		r.interval = time.Hour
+	case config.RotateMode == ROTATE_SIZE:
+		if r.maxSize <= 0 {
+			return nil, errors.New("FileSize is required when RotateMode is ROTATE_SIZE.")
+		}
+	default:
+		return nil, errors.New("Unknown rotate mode.")
+	}
+	switch {
+	case r.interval == 0:
+	case r.interval%(24*time.Hour) == 0:
+		r.dateFormat = "2006-01-02"
+	case r.interval%time.Hour == 0:
+		r.dateFormat = "2006-01-02-15"
+	case r.interval%time.Minute == 0:
+		r.dateFormat = "2006-01-02-15-04"
+	default:
+		r.dateFormat = "2006-01-02-15-04-05"
+	}
+
+	tmpl := config.FileNameTemplate
+	if tmpl == "" {
+		tmpl = defaultFileNameTemplate(config)
+	}
+	if r.interval > 0 && !strings.Contains(tmpl, TemplateTime) {
+		return nil, fmt.Errorf("FileNameTemplate %q must contain %s when rotating by time.", tmpl, TemplateTime)
+	}
+	if r.maxSize > 0 && !strings.Contains(tmpl, TemplateIndex) {
+		return nil, fmt.Errorf("FileNameTemplate %q must contain %s when rotating by size.", tmpl, TemplateIndex)
+	}
+	if strings.ContainsRune(tmpl, filepath.Separator) {
+		return nil, fmt.Errorf("FileNameTemplate %q must not contain a path separator.", tmpl)
+	}
+	hostname, _ := os.Hostname()
+	r.template = strings.NewReplacer(
+		TemplatePrefix, config.FileNamePrefix,
+		TemplateHostname, hostname,
+		TemplateAppId, config.AppId,
+	).Replace(tmpl)
+	r.pid = strconv.Itoa(os.Getpid())
+	r.owned = r.pattern(`.+?`, `\d+`)
+	r.mine = r.pattern(`.+?`, regexp.QuoteMeta(r.pid))
+	return r, nil
+}
+
+// 未设置 FileNameTemplate 时的文件名模板
+func defaultFileNameTemplate(config LogSinkConfig) string {
+	var tmpl string
+	if config.FileNamePrefix != "" {
+		tmpl = TemplatePrefix + "."
+	}
+	switch {
+	case config.RotateInterval <= 0 && config.RotateMode == ROTATE_SIZE:
+		return tmpl + "log." + TemplateIndex
+	case config.FileSize > 0:
+		return tmpl + "log." + TemplateTime + "_" + TemplateIndex
+	default:
+		return tmpl + "log." + TemplateTime
+	}
+}
+
+// MultiProcessUniqueName 模式下的文件名模板, 不包含 {pid} 时在末尾加上 .{pid}
+func uniqueFileNameTemplate(config LogSinkConfig) string {
+	tmpl := config.FileNameTemplate
+	if tmpl == "" {
+		tmpl = defaultFileNameTemplate(config)
+	}
+	if !strings.Contains(tmpl, TemplatePid) {
+		tmpl += "." + TemplatePid
+	}
+	return tmpl
+}
+
+// 匹配文件名的正则表达式, 时间段部分为 period, 进程号部分为 pid, 序号为第一个子匹配, 压缩后缀为第二个子匹配
+func (r *rotator) pattern(period, pid string) *regexp.Regexp {
+	exprs := map[string]string{TemplateTime: period, TemplateIndex: `(\d+)`, TemplatePid: pid}
+	var expr strings.Builder
+	expr.WriteString("^")
+	rest := r.template
+	for rest != "" {
+		// 找到最靠前的占位符
+		first, placeholder := -1, ""
+		for p := range exprs {
+			if i := strings.Index(rest, p); i >= 0 && (first < 0 || i < first) {
+				first, placeholder = i, p
+			}
+		}
+		if first < 0 {
+			expr.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		expr.WriteString(regexp.QuoteMeta(rest[:first]) + exprs[placeholder])
+		rest = rest[first+len(placeholder):]
+	}
+	if !strings.Contains(r.template, TemplateIndex) {
+		expr.WriteString(`()`)
+	}
+	expr.WriteString(`(\..+)?$`)
+	return regexp.MustCompile(expr.String())
+}
+
+// 写入 n 字节前调用, 返回应写入的文件名. 时间段变化时序号从 0 开始,
+// 当前文件写入后会超过大小上限时序号加 1. 空文件总是可以写入, 避免单条数据过大时反复切分
+func (r *rotator) next(n int64) string {
+	period := r.periodOf(r.now())
+	if period != r.period || !r.started {
+		r.started = true
+		r.period = period
+		r.resume()
+	} else if r.maxSize > 0 && r.size > 0 && r.size+n > r.maxSize {
+		r.index++
+		r.size = 0
+	}
+	return r.constructFileName(r.period, r.index)
+}
+
+// 当前文件已被其他进程写满或移走时调用, 重新扫描目录并返回应写入的文件名
+func (r *rotator) advance(n int64) string {
+	r.resume()
+	if r.maxSize > 0 && r.size > 0 && r.size+n > r.maxSize {
+		r.index++
+		r.size = 0
+	}
+	return r.constructFileName(r.period, r.index)
+}
+
+// 时间所在切分时间段的名称. 间隔不超过一天时按当天零点对齐, 如 15 分钟间隔的时间段从 00:00、00:15 ... 开始
+func (r *rotator) periodOf(t time.Time) string {
+	if r.interval == 0 {
+		return ""
+	}
+	var start time.Time
+	if r.interval <= 24*time.Hour {
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		start = midnight.Add(t.Sub(midnight) / r.interval * r.interval)
+	} else {
+		start = t.Truncate(r.interval)
+	}
+	return start.Format(r.dateFormat)
+}
+
+// 记录写入当前文件的字节数
+func (r *rotator) written(n int64) {
+	r.size += n
+}
+
+// 打开已有文件后同步文件大小
+func (r *rotator) reset(size int64) {
+	r.size = size
+}
+
+// 扫描目录中当前时间段已有的文件, 从序号最大的文件继续写入, 进程重启后不会覆盖或重复使用已写满的文件
+func (r *rotator) resume() {
+	r.index = 0
+	r.size = 0
+	if r.maxSize <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+	current := r.pattern(regexp.QuoteMeta(r.period), regexp.QuoteMeta(r.pid))
+	for _, f := range files {
+		m := current.FindStringSubmatch(f.Name())
+		if f.IsDir() || m == nil {
+			continue
+		}
+		i, err := strconv.Atoi(m[1])
+		if err != nil || i < r.index {
+			continue
+		}
+		// 已压缩的文件带有 .gz 等后缀, 不能再写入, 从下一个序号开始
+		if m[2] != "" {
+			r.index = i + 1
+			r.size = 0
+		} else if i > r.index || r.size == 0 {
+			r.index = i
+			r.size = f.Size()
+		}
+	}
+}
+
+// 判断目录中的文件是否由该切分器创建, 包括压缩后的文件. 文件名包含进程号时也包括其他进程(含已退出的进程)的文件
+func (r *rotator) owns(name string) bool {
+	return r.owned.MatchString(name)
+}
+
+// 判断文件是否是其他进程创建且未压缩的文件, 该进程可能仍在写入
+func (r *rotator) foreign(name string) bool {
+	if r.mine.MatchString(name) {
+		return false
+	}
+	m := r.owned.FindStringSubmatch(name)
+	return m != nil && m[len(m)-1] == ""
+}
+
+func (r *rotator) constructFileName(period string, i int) string {
+	name := strings.NewReplacer(TemplateTime, period, TemplateIndex, strconv.Itoa(i), TemplatePid, r.pid).Replace(r.template)
+	return fmt.Sprintf("%s/%s", r.dir, name)
+}
@@ -0,0 +1,175 @@
+package herodata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 可手动调整的时钟
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestRotator(t *testing.T, config LogSinkConfig, clock *fakeClock, maxSize int64) *rotator {
+	t.Helper()
+	r, err := newRotator(config, clock.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxSize = maxSize
+	return r
+}
+
+func TestRotatorPeriodBoundary(t *testing.T) {
+	tests := []struct {
+		mode   RotateMode
+		start  time.Time
+		before string
+		after  string
+	}{
+		{ROTATE_DAILY, time.Date(2024, 1, 1, 23, 59, 59, 0, time.UTC), "log.2024-01-01_2", "log.2024-01-02_0"},
+		{ROTATE_HOURLY, time.Date(2024, 1, 1, 9, 59, 59, 0, time.UTC), "log.2024-01-01-09_2", "log.2024-01-01-10_0"},
+	}
+	for _, tt := range tests {
+		clock := &fakeClock{tt.start}
+		r := newTestRotator(t, LogSinkConfig{Directory: t.TempDir(), RotateMode: tt.mode, FileSize: 1}, clock, 10)
+		var name string
+		for i := 0; i < 3; i++ {
+			name = r.next(8)
+			r.written(8)
+		}
+		if filepath.Base(name) != tt.before {
+			t.Fatalf("mode %d: got %s, want %s", tt.mode, filepath.Base(name), tt.before)
+		}
+
+		// 进入下一个时间段后序号从 0 开始
+		clock.t = clock.t.Add(time.Second)
+		if name := r.next(8); filepath.Base(name) != tt.after {
+			t.Fatalf("mode %d: got %s, want %s", tt.mode, filepath.Base(name), tt.after)
+		}
+		if r.index != 0 || r.size != 0 {
+			t.Fatalf("mode %d: index %d size %d after period change", tt.mode, r.index, r.size)
+		}
+	}
+}
+
+func TestRotatorSizeRollover(t *testing.T) {
+	clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	r := newTestRotator(t, LogSinkConfig{Directory: t.TempDir(), RotateMode: ROTATE_DAILY, FileSize: 1}, clock, 10)
+
+	steps := []struct {
+		n    int64
+		want string
+	}{
+		{4, "log.2024-01-01_0"},
+		{6, "log.2024-01-01_0"}, // 刚好写满
+		{1, "log.2024-01-01_1"},
+		{9, "log.2024-01-01_1"},
+		{20, "log.2024-01-01_2"}, // 超过上限的单条数据写入新文件
+		{1, "log.2024-01-01_3"},
+	}
+	for i, s := range steps {
+		if name := r.next(s.n); filepath.Base(name) != s.want {
+			t.Fatalf("step %d: got %s, want %s", i, filepath.Base(name), s.want)
+		}
+		r.written(s.n)
+	}
+
+	// 空文件总是可以写入, 避免单条数据过大时反复切分
+	r = newTestRotator(t, LogSinkConfig{Directory: t.TempDir(), RotateMode: ROTATE_DAILY, FileSize: 1}, clock, 10)
+	if name := r.next(20); filepath.Base(name) != "log.2024-01-01_0" {
+		t.Fatalf("got %s, want log.2024-01-01_0", filepath.Base(name))
+	}
+}
+
+func TestRotatorResume(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]int // 目录中已有的文件及其大小
+		want  string
+		size  int64
+	}{
+		{
+			name:  "empty",
+			files: nil,
+			want:  "log.2024-01-01_0",
+		},
+		{
+			name:  "numeric order",
+			files: map[string]int{"log.2024-01-01_0": 10, "log.2024-01-01_2": 10, "log.2024-01-01_10": 3},
+			want:  "log.2024-01-01_10",
+			size:  3,
+		},
+		{
+			name:  "compressed",
+			files: map[string]int{"log.2024-01-01_9": 10, "log.2024-01-01_10.gz": 1},
+			want:  "log.2024-01-01_11",
+		},
+		{
+			name:  "compressed with timestamp",
+			files: map[string]int{"log.2024-01-01_10": 10, "log.2024-01-01_11.1704096000000000000.gz": 1},
+			want:  "log.2024-01-01_12",
+		},
+		{
+			name:  "compressed before uncompressed",
+			files: map[string]int{"log.2024-01-01_2.gz": 1, "log.2024-01-01_3": 4},
+			want:  "log.2024-01-01_3",
+			size:  4,
+		},
+		{
+			name:  "other period",
+			files: map[string]int{"log.2023-12-31_20": 1, "other.2024-01-01_5": 1},
+			want:  "log.2024-01-01_0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, size := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+			r := newTestRotator(t, LogSinkConfig{Directory: dir, RotateMode: ROTATE_DAILY, FileSize: 1}, clock, 10)
+			if name := r.next(1); filepath.Base(name) != tt.want || r.size != tt.size {
+				t.Fatalf("got %s size %d, want %s size %d", filepath.Base(name), r.size, tt.want, tt.size)
+			}
+		})
+	}
+}
+
+// 进程重启后从序号最大的文件继续写入, 写满后切换到下一个序号
+func TestRotatorRestart(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	config := LogSinkConfig{Directory: dir, RotateMode: ROTATE_DAILY, FileSize: 1}
+
+	r := newTestRotator(t, config, clock, 10)
+	for i := 0; i < 11; i++ {
+		name := r.next(6)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("xxxxxx"))
+		f.Close()
+		r.written(6)
+	}
+
+	r = newTestRotator(t, config, clock, 10)
+	if name := r.next(3); filepath.Base(name) != "log.2024-01-01_10" {
+		t.Fatalf("got %s, want log.2024-01-01_10", filepath.Base(name))
+	}
+	r.written(3)
+	if name := r.next(3); filepath.Base(name) != "log.2024-01-01_11" {
+		t.Fatalf("got %s, want log.2024-01-01_11", filepath.Base(name))
+	}
+}
@@ -0,0 +1,150 @@
+package herodata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSpillMaxBytes = 100 * 1024 * 1024 // 默认磁盘队列上限 100MB
+
+	spillSuffix = ".seg" // 待发送的批次
+)
+
+var spillNamePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// 一批待发送的数据. 开启磁盘队列时 data 可能只保存在 segment 文件中, 发送前再读取
+type batch struct {
+	data     []Data
+	segment  string // 磁盘队列中的文件, 为空表示仅在内存中
+	size     int64  // segment 文件大小
+	count    int    // 数据条数
+	inflight bool   // 是否正在发送
+	unsaved  bool   // 开启磁盘队列时尚未写入磁盘
+}
+
+// 磁盘队列, 每个批次一个文件, 文件名为 序号-条数.seg, 按序号重放. 接收端响应前文件不会删除,
+// 被接收端拒绝的批次已通过 OnError 回调, 与确认的批次一样删除
+type spillQueue struct {
+	dir      string
+	maxBytes int64
+	seq      uint64
+	size     int64 // 所有待发送批次占用的字节数
+}
+
+// 打开接收端的磁盘队列, 并返回上次进程退出时未发送的批次
+func openSpillQueue(directory, name string, maxBytes int64) (*spillQueue, []*batch, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultSpillMaxBytes
+	}
+	q := &spillQueue{
+		dir:      filepath.Join(directory, spillNamePattern.ReplaceAllString(name, "_")),
+		maxBytes: maxBytes,
+	}
+	if err := os.MkdirAll(q.dir, os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var replay []*batch
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spillSuffix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(f.Name(), spillSuffix), "-", 2)
+		seq, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq > q.seq {
+			q.seq = seq
+		}
+		var count int
+		if len(parts) == 2 {
+			count, _ = strconv.Atoi(parts[1])
+		}
+		replay = append(replay, &batch{segment: filepath.Join(q.dir, f.Name()), size: f.Size(), count: count})
+		q.size += f.Size()
+	}
+	// 文件名为定长序号, 按名称排序即按写入顺序
+	sort.Slice(replay, func(i, j int) bool { return replay[i].segment < replay[j].segment })
+	return q, replay, nil
+}
+
+// 为批次分配磁盘队列中的文件名, 文件名中的序号决定重放顺序. 调用方需持有接收端的 mutex
+func (q *spillQueue) reserve(b *batch) string {
+	q.seq++
+	return filepath.Join(q.dir, fmt.Sprintf("%020d-%d%s", q.seq, len(b.data), spillSuffix))
+}
+
+// 将批次数据写入文件并同步到磁盘, 返回文件大小. 先写临时文件再改名, 避免进程崩溃时留下不完整的文件.
+// 不访问队列的状态, 写入时不需要持有锁
+func writeSegment(name string, data []Data) (int64, error) {
+	jdata, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Write(jdata); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return int64(len(jdata)), nil
+}
+
+// 记录已写入磁盘的批次, 调用方需持有接收端的 mutex
+func (q *spillQueue) add(b *batch, name string, size int64) {
+	b.segment = name
+	b.size = size
+	q.size += size
+}
+
+// 从磁盘读取批次数据
+func (q *spillQueue) read(b *batch) ([]Data, error) {
+	jdata, err := ioutil.ReadFile(b.segment)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %s", ErrSpillCorrupted, b.segment, err)
+	}
+	var data []Data
+	if err := json.Unmarshal(jdata, &data); err != nil {
+		return nil, fmt.Errorf("%w %s: %s", ErrSpillCorrupted, b.segment, err)
+	}
+	return data, nil
+}
+
+// 接收端响应后或文件无法读取时删除批次文件
+func (q *spillQueue) remove(b *batch) {
+	if b.segment == "" {
+		return
+	}
+	os.Remove(b.segment)
+	q.size -= b.size
+	b.segment = ""
+}
+
+func (q *spillQueue) full() bool {
+	return q.size > q.maxBytes
+}
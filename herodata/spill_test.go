@@ -0,0 +1,62 @@
+package herodata
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// 被接收端拒绝的批次通过 OnError 回调后删除, 不会一直占用磁盘
+func TestSpillRejectedRemoved(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"code":-2}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	var rejected []Data
+	consumer, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:      server.URL,
+		AppId:          "spill",
+		BatchSize:      1,
+		SpillDirectory: dir,
+		OnError: func(err error, data []Data) {
+			if errors.Is(err, ErrAppIdNotExist) {
+				rejected = append(rejected, data...)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		consumer.Add(Data{Type: "track", EventName: "e"})
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 3 {
+		t.Fatalf("got %d rejected events, want 3", len(rejected))
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "hero"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got %d files left in spill directory", len(files))
+	}
+}
+
+// 接收端名称决定磁盘队列目录, 不能重复
+func TestDestinationDuplicateName(t *testing.T) {
+	_, err := NewBatchConsumerWithConfig(BatchConfig{
+		ServerUrl:    "http://127.0.0.1:1",
+		Destinations: []DestinationConfig{{Name: "hero", ServerUrl: "http://127.0.0.1:2"}},
+	})
+	if err == nil {
+		t.Fatal("want error for duplicate destination name")
+	}
+}
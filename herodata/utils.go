@@ -1,6 +1,7 @@
 package herodata
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -21,20 +22,36 @@ func mergeProperties(target, source map[string]interface{}) {
 	}
 }
 
-func extractTime(p map[string]interface{}) string {
+// 返回 #time 格式化后的字符串和该时间的时区偏移(小时). loc 为 nil 时 time.Time 类型按其自身的时区格式化
+func extractTime(p map[string]interface{}, loc *time.Location) (string, float64) {
+	now := inLocation(time.Now(), loc)
 	if t, ok := p["#time"]; ok {
 		delete(p, "#time")
 		switch v := t.(type) {
 		case string:
-			return v
+			return v, zoneOffset(now)
 		case time.Time:
-			return v.Format(DATE_FORMAT)
+			v = inLocation(v, loc)
+			return v.Format(DATE_FORMAT), zoneOffset(v)
 		default:
-			return time.Now().Format(DATE_FORMAT)
+			return now.Format(DATE_FORMAT), zoneOffset(now)
 		}
 	}
 
-	return time.Now().Format(DATE_FORMAT)
+	return now.Format(DATE_FORMAT), zoneOffset(now)
+}
+
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return t
+	}
+	return t.In(loc)
+}
+
+// 时区偏移, 单位小时
+func zoneOffset(t time.Time) float64 {
+	_, offset := t.Zone()
+	return float64(offset) / 3600
 }
 
 func extractStringProperty(p map[string]interface{}, key string) string {
@@ -59,7 +76,8 @@ func isNotNumber(v interface{}) bool {
 	return false
 }
 
-func formatProperties(d *Data) error {
+// 检查数据格式, 并将时间类型的属性按 loc 转为字符串
+func formatProperties(d *Data, loc *time.Location) error {
 
 	if d.EventName != "" {
 		matched := checkPattern([]byte(d.EventName))
@@ -85,9 +103,9 @@ func formatProperties(d *Data) error {
 			case string:
 			case []string:
 			case time.Time:
-				d.Properties[k] = v.(time.Time).Format(DATE_FORMAT)
+				d.Properties[k] = inLocation(v.(time.Time), loc).Format(DATE_FORMAT)
 			case *time.Time:
-				d.Properties[k] = v.(*time.Time).Format(DATE_FORMAT)
+				d.Properties[k] = inLocation(*v.(*time.Time), loc).Format(DATE_FORMAT)
 			default:
 				if isNotNumber(v) {
 					return errors.New("Invalid property value type. Supported types: numbers, string, time.Time, bool, []string")
@@ -102,3 +120,28 @@ func formatProperties(d *Data) error {
 func checkPattern(name []byte) bool {
 	return keyPattern.Match(name)
 }
+
+// 回调 OnError, 未设置回调时打印到标准错误输出
+func reportError(callback func(err error, data []Data), err error, data []Data) {
+	if callback == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	callback(err, data)
+}
+
+// 与 reportError 相同, 数据为日志文件中的行, 无法解码的行被忽略
+func reportLines(callback func(err error, data []Data), err error, lines [][]byte) {
+	if callback == nil {
+		reportError(nil, err, nil)
+		return
+	}
+	var data []Data
+	for _, line := range lines {
+		var d Data
+		if e := json.Unmarshal(line, &d); e == nil {
+			data = append(data, d)
+		}
+	}
+	callback(err, data)
+}
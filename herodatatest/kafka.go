@@ -0,0 +1,132 @@
+package herodatatest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+// ProduceResult FakeKafkaProducer 对一次 Produce 的结果
+type ProduceResult struct {
+	Err   error         // 整批失败的错误, 不为 nil 时忽略 Errs, 所有消息都不会被确认
+	Errs  []error       // 按消息顺序的错误, nil 表示该消息被确认, 超出长度的消息都被确认
+	Delay time.Duration // 返回前等待的时间, 用于模拟超时. ctx 先取消时整批失败
+}
+
+// FakeKafkaProducer 内存中的 KafkaProducer, 记录被确认的消息,
+// 并可以按顺序指定每次 Produce 的结果, 用于测试 KafkaConsumer 的重试逻辑
+type FakeKafkaProducer struct {
+	mutex    sync.Mutex
+	messages []herodata.KafkaMessage
+	calls    int
+	script   []ProduceResult // 按顺序使用的结果, 用完后全部确认
+	closed   bool
+}
+
+// 创建 FakeKafkaProducer, 默认确认所有消息
+func NewFakeKafkaProducer() *FakeKafkaProducer {
+	return &FakeKafkaProducer{}
+}
+
+// Enqueue 指定接下来几次 Produce 的结果, 按顺序使用
+func (p *FakeKafkaProducer) Enqueue(results ...ProduceResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.script = append(p.script, results...)
+}
+
+// FailNext 接下来的 n 次 Produce 整批返回 err
+func (p *FakeKafkaProducer) FailNext(n int, err error) {
+	for i := 0; i < n; i++ {
+		p.Enqueue(ProduceResult{Err: err})
+	}
+}
+
+// Produce 按指定的结果确认消息, 部分消息失败时返回 *herodata.KafkaDeliveryError
+func (p *FakeKafkaProducer) Produce(ctx context.Context, messages []herodata.KafkaMessage) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return errors.New("producer closed")
+	}
+	p.calls++
+	var result ProduceResult
+	if len(p.script) > 0 {
+		result = p.script[0]
+		p.script = p.script[1:]
+	}
+	p.mutex.Unlock()
+
+	if result.Delay > 0 {
+		select {
+		case <-time.After(result.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if result.Err != nil {
+		return result.Err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	errs := make([]error, len(messages))
+	failed := false
+	for i, m := range messages {
+		if i < len(result.Errs) && result.Errs[i] != nil {
+			errs[i] = result.Errs[i]
+			failed = true
+			continue
+		}
+		p.messages = append(p.messages, m)
+	}
+	if failed {
+		return &herodata.KafkaDeliveryError{Errs: errs}
+	}
+	return nil
+}
+
+// Close 关闭后 Produce 返回错误
+func (p *FakeKafkaProducer) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	return nil
+}
+
+// Messages 返回所有被确认的消息
+func (p *FakeKafkaProducer) Messages() []herodata.KafkaMessage {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]herodata.KafkaMessage(nil), p.messages...)
+}
+
+// Events 返回所有被确认的消息解码后的数据, 无法解码的消息被忽略
+func (p *FakeKafkaProducer) Events() []herodata.Data {
+	var events []herodata.Data
+	for _, m := range p.Messages() {
+		var d herodata.Data
+		if err := json.Unmarshal(m.Value, &d); err == nil {
+			events = append(events, d)
+		}
+	}
+	return events
+}
+
+// Calls 返回 Produce 被调用的次数
+func (p *FakeKafkaProducer) Calls() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.calls
+}
+
+// Closed 返回是否已被关闭
+func (p *FakeKafkaProducer) Closed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
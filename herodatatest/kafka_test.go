@@ -0,0 +1,105 @@
+package herodatatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+func TestFakeKafkaProducerRetry(t *testing.T) {
+	p := NewFakeKafkaProducer()
+	unavailable := errors.New("leader not available")
+	p.Enqueue(ProduceResult{Errs: []error{nil, unavailable, nil}})
+	p.FailNext(1, unavailable)
+
+	var acks int
+	var failed []error
+	consumer, err := herodata.NewKafkaConsumerWithConfig(herodata.KafkaConfig{
+		Topic:     "events",
+		BatchSize: 3,
+		NewProducer: func(config herodata.KafkaProducerConfig) (herodata.KafkaProducer, error) {
+			acks = config.RequiredAcks
+			return p, nil
+		},
+		RetryPolicy: &herodata.RetryPolicy{BaseBackoff: time.Millisecond},
+		OnError:     func(err error, data []herodata.Data) { failed = append(failed, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acks != -1 {
+		t.Fatalf("got RequiredAcks %d, want -1 (all)", acks)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := consumer.Add(herodata.Data{AccountId: name, EventName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次 b 失败, 第二次整批失败, 第三次只重试 b
+	if calls := p.Calls(); calls != 3 {
+		t.Fatalf("got %d calls, want 3", calls)
+	}
+	events := p.Events()
+	if len(events) != 3 || events[0].EventName != "a" || events[1].EventName != "c" || events[2].EventName != "b" {
+		t.Fatalf("got %+v", events)
+	}
+	if string(p.Messages()[2].Key) != "b" {
+		t.Fatalf("got key %q, want b", p.Messages()[2].Key)
+	}
+	if len(failed) != 0 || !p.Closed() {
+		t.Fatalf("errors %v, closed %v", failed, p.Closed())
+	}
+}
+
+// 关闭超时时中断正在进行的定时发送
+func TestFakeKafkaProducerCloseTimeout(t *testing.T) {
+	p := NewFakeKafkaProducer()
+	p.Enqueue(ProduceResult{Delay: time.Minute})
+
+	consumer, err := herodata.NewKafkaConsumerWithConfig(herodata.KafkaConfig{
+		Topic:         "events",
+		Producer:      p,
+		FlushInterval: 10 * time.Millisecond,
+		OnError:       func(err error, data []herodata.Data) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer.Add(herodata.Data{EventName: "slow"})
+	for p.Calls() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	consumer.(herodata.ContextConsumer).CloseCtx(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("CloseCtx took %s", elapsed)
+	}
+	if len(p.Messages()) != 0 {
+		t.Fatalf("got %d messages, want 0", len(p.Messages()))
+	}
+}
+
+// 设置 Producer 时不能设置只传给 NewProducer 的配置
+func TestKafkaConsumerRejectsProducerConfig(t *testing.T) {
+	for _, config := range []herodata.KafkaConfig{
+		{Brokers: []string{"127.0.0.1:9092"}},
+		{Compression: herodata.KafkaCompressionGzip},
+		{RequiredAcks: herodata.KafkaAcksLeader},
+	} {
+		config.Topic = "events"
+		config.Producer = NewFakeKafkaProducer()
+		if _, err := herodata.NewKafkaConsumerWithConfig(config); err == nil {
+			t.Fatalf("want error for %+v", config)
+		}
+	}
+}
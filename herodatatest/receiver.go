@@ -0,0 +1,246 @@
+package herodatatest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+// 请求使用的协议
+const (
+	ProtocolBatch = "batch" // BatchConsumer 的协议, 请求体为 JSON 数组, 可能经过 gzip 压缩
+	ProtocolDebug = "debug" // DebugConsumer 的表单协议, data 字段为一条 JSON 数据
+)
+
+// Response 接收端对一次请求的响应
+type Response struct {
+	StatusCode int           // HTTP 状态码, 默认 200
+	Code       int           // 状态码为 200 时返回的 code, DebugConsumer 协议中为 errorLevel
+	Delay      time.Duration // 响应前等待的时间, 用于模拟网络延迟和超时. 客户端超时的请求仍按该响应记录
+	RetryAfter string        // Retry-After 响应头, 为空时不设置
+	Body       string        // 不为空时按原样返回该内容, 忽略 Code. 是否被接受按其中的 code 或 errorLevel 判断
+}
+
+// ReceivedBatch 接收端收到的一次请求
+type ReceivedBatch struct {
+	Protocol string          // ProtocolBatch 或 ProtocolDebug
+	Path     string          // 请求路径
+	AppId    string          // appid 请求头或表单字段
+	Compress string          // compress 请求头, BatchConsumer 协议有效
+	Count    int             // HERO-DATA-Integration-Count 或 TA-Integration-Count 请求头, BatchConsumer 协议有效
+	DryRun   bool            // dryRun 表单字段, DebugConsumer 协议有效
+	Header   http.Header     // 请求头
+	Data     []herodata.Data // 解码后的数据
+	Err      error           // 请求无法解码的原因, 此时响应 code 1
+	Response Response        // 返回的响应
+	Accepted bool            // 响应为 200 且 code 为 0, 即 Consumer 认为发送成功
+}
+
+// FakeReceiver 基于 httptest 的接收端, 支持 BatchConsumer 和 DebugConsumer 的协议,
+// 记录解码后的每次请求, 并可以按顺序指定每次请求的响应, 用于测试重试等逻辑.
+// 表单请求按 DebugConsumer 协议处理, 其他请求按 BatchConsumer 协议处理, 不区分路径
+type FakeReceiver struct {
+	URL    string // 接收端地址, 可用于 ServerUrl、ShuShuServerUrl 等配置
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	batches  []ReceivedBatch
+	script   []Response // 按顺序使用的响应, 用完后使用 fallback
+	fallback Response
+}
+
+// 创建并启动 FakeReceiver, 默认对每次请求返回 200 和 code 0. 使用完后需调用 Close
+func NewFakeReceiver() *FakeReceiver {
+	r := &FakeReceiver{}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	r.URL = r.server.URL
+	return r
+}
+
+// Close 关闭接收端
+func (r *FakeReceiver) Close() {
+	r.server.Close()
+}
+
+// Enqueue 指定接下来几次请求的响应, 按顺序使用, 用完后使用 SetDefault 设置的响应
+func (r *FakeReceiver) Enqueue(responses ...Response) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.script = append(r.script, responses...)
+}
+
+// FailNext 接下来的 n 次请求返回 HTTP 状态码 statusCode
+func (r *FakeReceiver) FailNext(n int, statusCode int) {
+	for i := 0; i < n; i++ {
+		r.Enqueue(Response{StatusCode: statusCode})
+	}
+}
+
+// SetDefault 设置没有指定响应时使用的响应
+func (r *FakeReceiver) SetDefault(response Response) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.fallback = response
+}
+
+// Batches 返回收到的所有请求, 包括返回错误的请求
+func (r *FakeReceiver) Batches() []ReceivedBatch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]ReceivedBatch(nil), r.batches...)
+}
+
+// Events 返回所有被接受的请求中的数据, 即接收端实际保存的数据
+func (r *FakeReceiver) Events() []herodata.Data {
+	var events []herodata.Data
+	for _, b := range r.Batches() {
+		if b.Accepted {
+			events = append(events, b.Data...)
+		}
+	}
+	return events
+}
+
+// Reset 清空记录的请求、指定的响应和默认响应
+func (r *FakeReceiver) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.batches = nil
+	r.script = nil
+	r.fallback = Response{}
+}
+
+// 取出下一次请求的响应
+func (r *FakeReceiver) next() Response {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.script) == 0 {
+		return r.fallback
+	}
+	response := r.script[0]
+	r.script = r.script[1:]
+	return response
+}
+
+func (r *FakeReceiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	var batch ReceivedBatch
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		batch = decodeDebug(req)
+	} else {
+		batch = decodeBatch(req)
+	}
+	batch.Path = req.URL.Path
+	batch.Header = req.Header.Clone()
+
+	response := r.next()
+	if batch.Err != nil && response.StatusCode == 0 && response.Body == "" && response.Code == 0 {
+		response.Code = 1
+	}
+	batch.Response = response
+	batch.Accepted = (response.StatusCode == 0 || response.StatusCode == http.StatusOK) && accepted(batch.Protocol, response)
+	r.mutex.Lock()
+	r.batches = append(r.batches, batch)
+	r.mutex.Unlock()
+
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if response.RetryAfter != "" {
+		w.Header().Set("Retry-After", response.RetryAfter)
+	}
+	if response.StatusCode != 0 && response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		return
+	}
+	switch {
+	case response.Body != "":
+		io.WriteString(w, response.Body)
+	case batch.Protocol == ProtocolDebug:
+		fmt.Fprintf(w, `{"errorLevel":%d}`, response.Code)
+	default:
+		fmt.Fprintf(w, `{"code":%d}`, response.Code)
+	}
+}
+
+// 状态码为 200 时响应是否表示数据被接受. 设置了 Body 时与 Consumer 一样解析其中的 code 或 errorLevel,
+// 无法解析时不被接受
+func accepted(protocol string, response Response) bool {
+	if response.Body == "" {
+		return response.Code == 0
+	}
+	var result struct {
+		Code       int `json:"code"`
+		ErrorLevel int `json:"errorLevel"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &result); err != nil {
+		return false
+	}
+	if protocol == ProtocolDebug {
+		return result.ErrorLevel == 0
+	}
+	return result.Code == 0
+}
+
+// 按 BatchConsumer 协议解码请求
+func decodeBatch(req *http.Request) ReceivedBatch {
+	batch := ReceivedBatch{
+		Protocol: ProtocolBatch,
+		AppId:    req.Header.Get("appid"),
+		Compress: req.Header.Get("compress"),
+	}
+	count := req.Header.Get("HERO-DATA-Integration-Count")
+	if count == "" {
+		count = req.Header.Get("TA-Integration-Count")
+	}
+	batch.Count, _ = strconv.Atoi(count)
+
+	var body io.Reader = req.Body
+	if batch.Compress == "gzip" {
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			batch.Err = err
+			return batch
+		}
+		defer gr.Close()
+		body = gr
+	}
+	content, err := ioutil.ReadAll(body)
+	if err == nil {
+		err = json.Unmarshal(content, &batch.Data)
+	}
+	batch.Err = err
+	return batch
+}
+
+// 按 DebugConsumer 协议解码请求
+func decodeDebug(req *http.Request) ReceivedBatch {
+	batch := ReceivedBatch{Protocol: ProtocolDebug}
+	if err := req.ParseForm(); err != nil {
+		batch.Err = err
+		return batch
+	}
+	batch.AppId = req.PostForm.Get("appid")
+	batch.DryRun = req.PostForm.Get("dryRun") == "1"
+	var d herodata.Data
+	if err := json.Unmarshal([]byte(req.PostForm.Get("data")), &d); err != nil {
+		batch.Err = err
+		return batch
+	}
+	batch.Count = 1
+	batch.Data = []herodata.Data{d}
+	return batch
+}
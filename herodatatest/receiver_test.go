@@ -0,0 +1,155 @@
+package herodatatest
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+// 按 Enqueue 的顺序响应, 用完后使用 SetDefault 设置的响应
+func TestFakeReceiverScript(t *testing.T) {
+	receiver := NewFakeReceiver()
+	defer receiver.Close()
+	receiver.FailNext(1, http.StatusServiceUnavailable)
+	receiver.Enqueue(Response{Code: -2})
+	receiver.SetDefault(Response{RetryAfter: "1"})
+
+	consumer, err := herodata.NewBatchConsumerWithConfig(herodata.BatchConfig{
+		ServerUrl:   receiver.URL,
+		AppId:       "app",
+		BatchSize:   1,
+		RetryPolicy: &herodata.RetryPolicy{BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		OnError:     func(err error, data []herodata.Data) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+
+	if err := consumer.Add(herodata.Data{EventName: "a"}); !errors.Is(err, herodata.ErrUnexpectedStatus) {
+		t.Fatalf("got %v, want ErrUnexpectedStatus", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := consumer.Flush(); !errors.Is(err, herodata.ErrAppIdNotExist) {
+		t.Fatalf("got %v, want ErrAppIdNotExist", err)
+	}
+	if err := consumer.Add(herodata.Data{EventName: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := receiver.Batches()
+	if len(batches) != 3 {
+		t.Fatalf("got %d requests, want 3", len(batches))
+	}
+	want := []Response{{StatusCode: http.StatusServiceUnavailable}, {Code: -2}, {RetryAfter: "1"}}
+	for i, b := range batches {
+		if b.Response != want[i] || b.Accepted != (i == 2) {
+			t.Fatalf("request %d: got %+v, accepted %v", i, b.Response, b.Accepted)
+		}
+	}
+	if events := receiver.Events(); len(events) != 1 || events[0].EventName != "b" {
+		t.Fatalf("got %v", events)
+	}
+}
+
+// 设置 Body 时按其中的 code 判断是否被接受, 与 BatchConsumer 的判断一致
+func TestFakeReceiverBody(t *testing.T) {
+	receiver := NewFakeReceiver()
+	defer receiver.Close()
+	receiver.Enqueue(Response{Body: `{"code":0,"msg":"ok"}`}, Response{Body: `{"code":-2}`}, Response{Body: `not json`})
+
+	consumer, err := herodata.NewBatchConsumerWithConfig(herodata.BatchConfig{
+		ServerUrl: receiver.URL,
+		AppId:     "app",
+		BatchSize: 1,
+		OnError:   func(err error, data []herodata.Data) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	for _, name := range []string{"ok", "rejected", "invalid"} {
+		err := consumer.Add(herodata.Data{EventName: name})
+		if (err == nil) != (name == "ok") {
+			t.Fatalf("%s: got %v", name, err)
+		}
+	}
+
+	batches := receiver.Batches()
+	if len(batches) != 3 || !batches[0].Accepted || batches[1].Accepted || batches[2].Accepted {
+		t.Fatalf("got %+v", batches)
+	}
+	if events := receiver.Events(); len(events) != 1 || events[0].EventName != "ok" {
+		t.Fatalf("got %v", events)
+	}
+}
+
+// 解码 gzip 压缩的 BatchConsumer 请求及其请求头
+func TestFakeReceiverGzip(t *testing.T) {
+	receiver := NewFakeReceiver()
+	defer receiver.Close()
+	consumer, err := herodata.NewBatchConsumerWithConfig(herodata.BatchConfig{
+		ServerUrl: receiver.URL,
+		AppId:     "app",
+		BatchSize: 2,
+		Compress:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := herodata.New(consumer)
+	ta.Track("user", "", "a", map[string]interface{}{"n": 1})
+	ta.Track("user", "", "b", nil)
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := receiver.Batches()
+	if len(batches) != 1 {
+		t.Fatalf("got %d requests, want 1", len(batches))
+	}
+	b := batches[0]
+	if b.Protocol != ProtocolBatch || b.Compress != "gzip" || b.AppId != "app" || b.Count != 2 || b.Err != nil {
+		t.Fatalf("got %+v", b)
+	}
+	if len(b.Data) != 2 || b.Data[0].EventName != "a" || b.Data[0].AccountId != "user" || b.Data[1].EventName != "b" {
+		t.Fatalf("got %+v", b.Data)
+	}
+}
+
+// 解码 DebugConsumer 的表单请求, Code 作为 errorLevel 返回
+func TestFakeReceiverDebugForm(t *testing.T) {
+	receiver := NewFakeReceiver()
+	defer receiver.Close()
+	receiver.Enqueue(Response{Code: 2})
+	consumer, err := herodata.NewDebugConsumerWithWriter(receiver.URL, "app", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := herodata.New(consumer)
+
+	err = ta.Track("user", "", "invalid", nil)
+	var re *herodata.ReceiverError
+	if !errors.As(err, &re) || re.Code != 2 || !re.Dropped {
+		t.Fatalf("got %v, want ReceiverError with code 2", err)
+	}
+	if err := ta.Track("user", "", "valid", map[string]interface{}{"level": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := receiver.Batches()
+	if len(batches) != 2 {
+		t.Fatalf("got %d requests, want 2", len(batches))
+	}
+	for i, b := range batches {
+		if b.Protocol != ProtocolDebug || b.AppId != "app" || !b.DryRun || b.Count != 1 || b.Accepted != (i == 1) {
+			t.Fatalf("request %d: got %+v", i, b)
+		}
+	}
+	if events := receiver.Events(); len(events) != 1 || events[0].EventName != "valid" || events[0].Properties["level"] != float64(3) {
+		t.Fatalf("got %v", events)
+	}
+}
@@ -0,0 +1,151 @@
+// Package herodatatest 提供测试 herodata 时使用的工具
+package herodatatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+// RecordingConsumer 在内存中记录收到的每条数据, 用于单元测试.
+// 记录的是 TDAnalytics 合并公共属性并格式化之后交给 Consumer 的数据
+type RecordingConsumer struct {
+	mutex   sync.Mutex
+	events  []herodata.Data
+	flushed int
+	closed  bool
+}
+
+// 创建 RecordingConsumer
+func NewRecordingConsumer() *RecordingConsumer {
+	return &RecordingConsumer{}
+}
+
+func (c *RecordingConsumer) Add(d herodata.Data) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return herodata.ErrConsumerClosed
+	}
+	// 复制属性, 避免调用方之后修改 map 影响记录的数据
+	props := make(map[string]interface{}, len(d.Properties))
+	for k, v := range d.Properties {
+		props[k] = v
+	}
+	d.Properties = props
+	c.events = append(c.events, d)
+	return nil
+}
+
+func (c *RecordingConsumer) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flushed++
+	return nil
+}
+
+func (c *RecordingConsumer) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Events 返回收到的所有数据, 按收到的顺序排列
+func (c *RecordingConsumer) Events() []herodata.Data {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]herodata.Data(nil), c.events...)
+}
+
+// FindByEventName 返回事件名为 name 的所有数据
+func (c *RecordingConsumer) FindByEventName(name string) []herodata.Data {
+	var result []herodata.Data
+	for _, d := range c.Events() {
+		if d.EventName == name {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// Flushed 返回 Flush 被调用的次数
+func (c *RecordingConsumer) Flushed() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.flushed
+}
+
+// Closed 返回是否已调用 Close
+func (c *RecordingConsumer) Closed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// Reset 清空记录的数据和状态, 关闭后也可以重新使用
+func (c *RecordingConsumer) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = nil
+	c.flushed = 0
+	c.closed = false
+}
+
+// AssertTracked 断言至少有一条事件名为 name 的数据包含 props 中的所有属性, 否则标记测试失败.
+// 属性值按 JSON 序列化后的结果比较, 如 int 1 与 float64 1 相等; time.Time 需传入格式化后的字符串
+func (c *RecordingConsumer) AssertTracked(t testing.TB, name string, props map[string]interface{}) bool {
+	t.Helper()
+	events := c.FindByEventName(name)
+	if len(events) == 0 {
+		t.Errorf("herodatatest: event %q was not tracked, got %s", name, eventNames(c.Events()))
+		return false
+	}
+	for _, d := range events {
+		if containsProperties(d.Properties, props) {
+			return true
+		}
+	}
+	t.Errorf("herodatatest: no %q event has properties %v, got %v", name, props, propertiesOf(events))
+	return false
+}
+
+// 判断 actual 是否包含 expected 中的所有属性
+func containsProperties(actual, expected map[string]interface{}) bool {
+	for k, want := range expected {
+		got, ok := actual[k]
+		if !ok || !equalValue(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalValue(got, want interface{}) bool {
+	if reflect.DeepEqual(got, want) {
+		return true
+	}
+	g, err1 := json.Marshal(got)
+	w, err2 := json.Marshal(want)
+	return err1 == nil && err2 == nil && string(g) == string(w)
+}
+
+func eventNames(events []herodata.Data) []string {
+	names := make([]string, 0, len(events))
+	for _, d := range events {
+		names = append(names, fmt.Sprintf("%s(%s)", d.EventName, d.Type))
+	}
+	return names
+}
+
+func propertiesOf(events []herodata.Data) []map[string]interface{} {
+	props := make([]map[string]interface{}, 0, len(events))
+	for _, d := range events {
+		props = append(props, d.Properties)
+	}
+	return props
+}
@@ -0,0 +1,79 @@
+package herodatatest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zhanqixuan/hero-data-sdk/herodata"
+)
+
+// 记录断言失败的 testing.TB
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingTB) Helper() {}
+
+func (t *recordingTB) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+// AssertTracked 按 JSON 序列化后的结果比较属性值, 记录的是 TDAnalytics 合并公共属性之后的数据
+func TestRecordingConsumerAssertTracked(t *testing.T) {
+	consumer := NewRecordingConsumer()
+	ta := herodata.New(consumer)
+	ta.SetSuperProperties(map[string]interface{}{"channel": "store"})
+	if err := ta.Track("user", "", "login", map[string]interface{}{
+		"level": 3,
+		"tags":  []string{"a", "b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !consumer.AssertTracked(t, "login", map[string]interface{}{
+		"level":   float64(3),
+		"tags":    []interface{}{"a", "b"},
+		"channel": "store",
+	}) {
+		return
+	}
+
+	tests := []struct {
+		name  string
+		props map[string]interface{}
+	}{
+		{"logout", nil},
+		{"login", map[string]interface{}{"level": 4}},
+		{"login", map[string]interface{}{"missing": true}},
+	}
+	for _, tt := range tests {
+		tb := &recordingTB{TB: t}
+		if consumer.AssertTracked(tb, tt.name, tt.props) || len(tb.errors) != 1 {
+			t.Fatalf("AssertTracked(%q, %v) passed, errors %v", tt.name, tt.props, tb.errors)
+		}
+	}
+}
+
+// Reset 后可以重新使用已关闭的 RecordingConsumer
+func TestRecordingConsumerReset(t *testing.T) {
+	consumer := NewRecordingConsumer()
+	ta := herodata.New(consumer)
+	ta.Track("user", "", "login", nil)
+	ta.Flush()
+	ta.Close()
+	if len(consumer.FindByEventName("login")) != 1 || consumer.Flushed() != 1 || !consumer.Closed() {
+		t.Fatalf("events %v, flushed %d, closed %v", consumer.Events(), consumer.Flushed(), consumer.Closed())
+	}
+	if err := consumer.Add(herodata.Data{EventName: "late"}); err != herodata.ErrConsumerClosed {
+		t.Fatalf("got %v, want ErrConsumerClosed", err)
+	}
+
+	consumer.Reset()
+	if err := consumer.Add(herodata.Data{EventName: "again"}); err != nil {
+		t.Fatal(err)
+	}
+	if events := consumer.Events(); len(events) != 1 || events[0].EventName != "again" {
+		t.Fatalf("got %v", events)
+	}
+}